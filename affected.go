@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// goPackage is the part of `go list -json` output gobuild uses
+type goPackage struct {
+	Dir          string
+	ImportPath   string
+	Standard     bool
+	GoFiles      []string
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+// listPackages runs `go list` on dirs, chunkSize directories at a time
+func listPackages(ctx context.Context, dirs []string, chunkSize int) ([]goPackage, error) {
+	patterns := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = "." + string(filepath.Separator) + dir
+		}
+		patterns = append(patterns, dir)
+	}
+	return listPackagePatterns(ctx, patterns, chunkSize)
+}
+
+// listPackagePatterns runs `go list` on package patterns or import paths, chunkSize at a time
+func listPackagePatterns(ctx context.Context, patterns []string, chunkSize int) ([]goPackage, error) {
+	ret := make([]goPackage, 0, len(patterns))
+	for _, chunk := range chunkStrings(patterns, chunkSize) {
+		pkgs, err := goList(ctx, chunk)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, pkgs...)
+	}
+	return ret, nil
+}
+
+// listDeps runs `go list` on dir and every package it, or its tests, import transitively
+func listDeps(ctx context.Context, dir string) ([]goPackage, error) {
+	if !filepath.IsAbs(dir) {
+		dir = "." + string(filepath.Separator) + dir
+	}
+	return goList(ctx, []string{"-deps", "-test", dir})
+}
+
+func goList(ctx context.Context, args []string) ([]goPackage, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", append([]string{"list", "-e", "-json"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runCmd(ctx, cmd); err != nil {
+		return nil, wraperr(err, "go list failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	ret := make([]goPackage, 0, len(args))
+	dec := json.NewDecoder(&stdout)
+	for {
+		var pkg goPackage
+		if err := dec.Decode(&pkg); err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return nil, wraperr(err, "cannot decode go list output")
+		}
+		ret = append(ret, pkg)
+	}
+}
+
+// dependentPackages returns the import paths of every package in pkgs that imports one of changed,
+// directly or transitively.  A package whose tests import a changed package is included, but
+// packages importing it are not, since its non-test code did not change.
+func dependentPackages(pkgs []goPackage, changed []string) map[string]struct{} {
+	importedBy := make(map[string][]string, len(pkgs))
+	testImportedBy := make(map[string][]string, len(pkgs))
+	for _, pkg := range pkgs {
+		for _, imp := range pkg.Imports {
+			importedBy[imp] = append(importedBy[imp], pkg.ImportPath)
+		}
+		for _, imp := range append(append([]string{}, pkg.TestImports...), pkg.XTestImports...) {
+			testImportedBy[imp] = append(testImportedBy[imp], pkg.ImportPath)
+		}
+	}
+	affected := make(map[string]struct{}, len(changed))
+	visited := make(map[string]struct{}, len(changed))
+	toVisit := append([]string{}, changed...)
+	for len(toVisit) > 0 {
+		cur := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if _, exists := visited[cur]; exists {
+			continue
+		}
+		visited[cur] = struct{}{}
+		affected[cur] = struct{}{}
+		toVisit = append(toVisit, importedBy[cur]...)
+		for _, testImporter := range testImportedBy[cur] {
+			affected[testImporter] = struct{}{}
+		}
+	}
+	return affected
+}
+
+// withDependents returns changed plus every directory in all holding a package that depends on a
+// package in changed
+func (p *pathExpansion) withDependents(ctx context.Context, all map[string]struct{}, changed map[string]struct{}) (map[string]struct{}, error) {
+	dirs := make([]string, 0, len(all))
+	for d := range all {
+		dirs = append(dirs, d)
+	}
+	pkgs, err := listPackages(ctx, dirs, p.chunkSize)
+	if err != nil {
+		return nil, wraperr(err, "cannot list packages")
+	}
+	byRealPath := make(map[string]string, len(all))
+	for d := range all {
+		byRealPath[realPath(d)] = d
+	}
+	changedImports := make([]string, 0, len(changed))
+	for _, pkg := range pkgs {
+		if d, exists := byRealPath[realPath(pkg.Dir)]; exists {
+			if _, exists := changed[d]; exists {
+				changedImports = append(changedImports, pkg.ImportPath)
+			}
+		}
+	}
+	affected := dependentPackages(pkgs, changedImports)
+	ret := make(map[string]struct{}, len(changed))
+	for d := range changed {
+		ret[d] = struct{}{}
+	}
+	for _, pkg := range pkgs {
+		if _, exists := affected[pkg.ImportPath]; !exists {
+			continue
+		}
+		if d, exists := byRealPath[realPath(pkg.Dir)]; exists {
+			p.log.Printf("Including %s: depends on a changed package", d)
+			ret[d] = struct{}{}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// maxExactSamples is the largest sample size for which mannWhitneyU computes an exact p-value
+const maxExactSamples = 20
+
+// mannWhitneyU returns the two sided p-value of the Mann-Whitney U test that x and y come from the
+// same distribution.  This is the test benchstat uses.  Small samples without ties use the exact
+// distribution of U, everything else uses the normal approximation.
+func mannWhitneyU(x, y []float64) float64 {
+	n1, n2 := len(x), len(y)
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	type sample struct {
+		v     float64
+		fromX bool
+	}
+	all := make([]sample, 0, n1+n2)
+	for _, v := range x {
+		all = append(all, sample{v, true})
+	}
+	for _, v := range y {
+		all = append(all, sample{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Rank the samples, giving tied samples the average of their ranks
+	rankSumX := 0.0
+	tieCorrection := 0.0
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromX {
+				rankSumX += rank
+			}
+		}
+		if t := float64(j - i); t > 1 {
+			tieCorrection += t*t*t - t
+		}
+		i = j
+	}
+	u1 := rankSumX - float64(n1*(n1+1))/2
+	u := math.Min(u1, float64(n1*n2)-u1)
+
+	if tieCorrection == 0 && n1 <= maxExactSamples && n2 <= maxExactSamples {
+		return math.Min(1, 2*exactUCDF(n1, n2, int(u)))
+	}
+	n := float64(n1 + n2)
+	mean := float64(n1*n2) / 2
+	variance := float64(n1*n2) / 12 * ((n + 1) - tieCorrection/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := (u - mean + 0.5) / math.Sqrt(variance)
+	return math.Min(1, 2*normalCDF(z))
+}
+
+// exactUCDF returns P(U <= u) for samples of size n1 and n2 under the null hypothesis
+func exactUCDF(n1, n2, u int) float64 {
+	// counts[i][j][k] is the number of orderings of i x samples and j y samples with U = k
+	counts := make([][][]float64, n1+1)
+	for i := range counts {
+		counts[i] = make([][]float64, n2+1)
+		for j := range counts[i] {
+			counts[i][j] = make([]float64, i*j+1)
+			if i == 0 || j == 0 {
+				counts[i][j][0] = 1
+				continue
+			}
+			for k := range counts[i][j] {
+				// The largest sample is either an x, which beats all j y samples, or a y
+				if k-j >= 0 && k-j < len(counts[i-1][j]) {
+					counts[i][j][k] += counts[i-1][j][k-j]
+				}
+				if k < len(counts[i][j-1]) {
+					counts[i][j][k] += counts[i][j-1][k]
+				}
+			}
+		}
+	}
+	total, below := 0.0, 0.0
+	for k, c := range counts[n1][n2] {
+		total += c
+		if k <= u {
+			below += c
+		}
+	}
+	return below / total
+}
+
+func normalCDF(z float64) float64 {
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
+
+func median(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[mid]
+	}
+	return (sorted[mid-1] + sorted[mid]) / 2
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// gitOutput runs git with args and returns its trimmed stdout
+func gitOutput(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runCmd(ctx, cmd); err != nil {
+		return "", wraperr(err, "git %s failed: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// gitMergeBase returns the commit where HEAD forked from ref
+func gitMergeBase(ctx context.Context, ref string) (string, error) {
+	return gitOutput(ctx, "merge-base", ref, "HEAD")
+}
+
+// gitChangedFiles returns the absolute paths of files that differ between the working tree and the
+// merge base of ref and HEAD, including untracked files
+func gitChangedFiles(ctx context.Context, ref string) ([]string, error) {
+	top, err := gitOutput(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, wraperr(err, "cannot find git root")
+	}
+	base, err := gitMergeBase(ctx, ref)
+	if err != nil {
+		return nil, wraperr(err, "cannot find merge base of %s", ref)
+	}
+	// core.quotePath=false keeps non ASCII names readable; gitUnquote handles the names git still quotes
+	diffed, err := gitOutput(ctx, "-c", "core.quotePath=false", "diff", "--name-only", base)
+	if err != nil {
+		return nil, wraperr(err, "cannot diff against %s", base)
+	}
+	untracked, err := gitOutput(ctx, "-c", "core.quotePath=false", "ls-files", "--others", "--exclude-standard", "--full-name", top)
+	if err != nil {
+		return nil, wraperr(err, "cannot list untracked files")
+	}
+	ret := make([]string, 0, 10)
+	for _, out := range []string{diffed, untracked} {
+		s := bufio.NewScanner(strings.NewReader(out))
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" {
+				ret = append(ret, filepath.Join(top, filepath.FromSlash(gitUnquote(line))))
+			}
+		}
+	}
+	return ret, nil
+}
+
+// realPath returns the absolute, symlink free version of path, or path itself if that fails
+func realPath(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	symPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return absPath
+	}
+	return symPath
+}
+
+// changedDirs returns the set of real directory paths containing a file changed since ref
+func changedDirs(ctx context.Context, ref string) (map[string]struct{}, error) {
+	files, err := gitChangedFiles(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		ret[realPath(filepath.Dir(f))] = struct{}{}
+	}
+	return ret, nil
+}
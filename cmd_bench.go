@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// benchResults maps directory to benchmark name to unit to every sample of that benchmark
+type benchResults map[string]map[string]map[string][]float64
+
+var benchLine = regexp.MustCompile(`^(Benchmark\S*)\s+(\d+)\s+(.+)$`)
+
+// parseBenchOutput reads the samples out of `go test -bench` output
+func parseBenchOutput(out []byte) map[string]map[string][]float64 {
+	ret := make(map[string]map[string][]float64)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		m := benchLine.FindStringSubmatch(strings.TrimSpace(s.Text()))
+		if m == nil {
+			continue
+		}
+		fields := strings.Fields(m[3])
+		for i := 0; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				break
+			}
+			if ret[m[1]] == nil {
+				ret[m[1]] = make(map[string][]float64)
+			}
+			ret[m[1]][fields[i+1]] = append(ret[m[1]][fields[i+1]], v)
+		}
+	}
+	return ret
+}
+
+func loadBenchResults(filename string) (benchResults, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(benchResults)
+	err = json.NewDecoder(f).Decode(&ret)
+	if err := multiErr([]error{err, f.Close()}); err != nil {
+		return nil, wraperr(err, "cannot decode benchmark results %s", filename)
+	}
+	return ret, nil
+}
+
+func (b benchResults) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(b)
+}
+
+// higherIsBetter is true for benchmark units where an increase is an improvement
+func higherIsBetter(unit string) bool {
+	return strings.HasSuffix(unit, "/s")
+}
+
+type benchCmd struct {
+	dirs  []string
+	cache *templateCache
+
+	baselineFilename string
+	updateBaseline   bool
+
+	verboseLog logger
+	errLog     logger
+
+	cmdStdout  cmdOutputStreamer
+	cmdStderr  cmdOutputStreamer
+	resultsOut io.Writer
+	summaryOut io.Writer
+}
+
+type benchDirResult struct {
+	stdout  bytes.Buffer
+	stderr  bytes.Buffer
+	samples map[string]map[string][]float64
+	err     error
+}
+
+func (b *benchCmd) Run(ctx context.Context) error {
+	allErrs := make([]error, 0, len(b.dirs))
+	current := make(benchResults, len(b.dirs))
+	results := make([]benchDirResult, len(b.dirs))
+	// Benchmarks always run one directory at a time: running them in parallel would skew timings
+	runOrdered(1, len(b.dirs), false, func(i int) error {
+		results[i].samples, results[i].err = b.benchDir(ctx, b.dirs[i], &results[i])
+		return results[i].err
+	}, func(i int) {
+		dir := b.dirs[i]
+		r := &results[i]
+		err := multiErr([]error{
+			r.err,
+			copyToStreamer(b.cmdStdout, dir, &r.stdout),
+			copyToStreamer(b.cmdStderr, dir, &r.stderr),
+		})
+		if err != nil {
+			b.errLog.Printf("Benchmark failure on %s: %s", dir, err.Error())
+			allErrs = append(allErrs, err)
+		}
+		if len(r.samples) > 0 {
+			current[dir] = r.samples
+		}
+	})
+	if err := current.write(b.resultsOut); err != nil {
+		allErrs = append(allErrs, wraperr(err, "cannot write benchmark results"))
+	}
+	if err := b.compareToBaseline(current); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	return multiErr(allErrs)
+}
+
+func (b *benchCmd) benchDir(ctx context.Context, dir string, r *benchDirResult) (map[string]map[string][]float64, error) {
+	tmpl, err := b.cache.loadInDir(dir)
+	if err != nil {
+		return nil, wraperr(err, "unable to load template for %s", dir)
+	}
+	args := append([]string{"test", "-run", "^$"}, tmpl.BenchFlags()...)
+	args = append(args, ".")
+	var out bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Stdout = io.MultiWriter(&out, &r.stdout)
+	cmd.Stderr = &r.stderr
+	b.verboseLog.Printf("Running [cmd=%s args=%s dir=%s]", cmd.Path, strings.Join(cmd.Args, " "), cmd.Dir)
+	if err := runCmd(ctx, cmd); err != nil {
+		return nil, wraperr(err, "benchmarks failed for %s", dir)
+	}
+	return parseBenchOutput(out.Bytes()), nil
+}
+
+// benchComparison is one benchmark metric compared to its baseline
+type benchComparison struct {
+	dir       string
+	name      string
+	unit      string
+	old       float64
+	new       float64
+	delta     float64
+	p         float64
+	threshold float64
+	alpha     float64
+	regressed bool
+}
+
+func (c *benchComparison) String() string {
+	status := ""
+	if c.regressed {
+		status = fmt.Sprintf("  REGRESSION > %.1f%%", c.threshold)
+	} else if c.p >= c.alpha {
+		status = "  ~"
+	}
+	return fmt.Sprintf("  %s %s %s: %.4g -> %.4g (%+.2f%% p=%.3f)%s", c.dir, c.name, c.unit, c.old, c.new, c.delta, c.p, status)
+}
+
+// compare returns every metric in both current and baseline.  A metric regresses when it got worse
+// by more than the directory's threshold and the change is statistically significant.
+func (b *benchCmd) compare(current benchResults, baseline benchResults) ([]benchComparison, error) {
+	ret := make([]benchComparison, 0, len(current))
+	for _, dir := range current.sortedDirs() {
+		tmpl, err := b.cache.loadInDir(dir)
+		if err != nil {
+			return nil, wraperr(err, "unable to load template for %s", dir)
+		}
+		for _, name := range sortedBenchmarks(current[dir]) {
+			for _, unit := range sortedUnits(current[dir][name]) {
+				oldSamples := baseline[dir][name][unit]
+				if len(oldSamples) == 0 {
+					continue
+				}
+				newSamples := current[dir][name][unit]
+				c := benchComparison{
+					dir:       dir,
+					name:      name,
+					unit:      unit,
+					old:       median(oldSamples),
+					new:       median(newSamples),
+					p:         mannWhitneyU(oldSamples, newSamples),
+					threshold: tmpl.BenchThreshold(),
+					alpha:     tmpl.BenchAlpha(),
+				}
+				if c.old != 0 {
+					c.delta = (c.new - c.old) / c.old * 100
+				}
+				worse := c.delta
+				if higherIsBetter(unit) {
+					worse = -worse
+				}
+				c.regressed = worse > c.threshold && c.p < c.alpha
+				ret = append(ret, c)
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (b *benchCmd) compareToBaseline(current benchResults) error {
+	if b.baselineFilename == "" {
+		return nil
+	}
+	baseline, err := loadBenchResults(b.baselineFilename)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(b.summaryOut, "no benchmark baseline at %s\n", b.baselineFilename)
+		baseline = make(benchResults)
+	} else if err != nil {
+		return wraperr(err, "cannot load benchmark baseline")
+	}
+	comparisons, err := b.compare(current, baseline)
+	if err != nil {
+		return err
+	}
+	regressions := make([]string, 0, len(comparisons))
+	if len(comparisons) > 0 {
+		fmt.Fprintf(b.summaryOut, "benchmarks compared to %s:\n", b.baselineFilename)
+	}
+	for i := range comparisons {
+		fmt.Fprintln(b.summaryOut, comparisons[i].String())
+		if comparisons[i].regressed {
+			regressions = append(regressions, fmt.Sprintf("%s %s %s", comparisons[i].dir, comparisons[i].name, comparisons[i].unit))
+		}
+	}
+	if b.updateBaseline {
+		for dir, samples := range current {
+			baseline[dir] = samples
+		}
+		if err := writeBenchBaseline(b.baselineFilename, baseline); err != nil {
+			return err
+		}
+		b.verboseLog.Printf("Updated benchmark baseline %s", b.baselineFilename)
+		return nil
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf("benchmark regressions: %s", strings.Join(regressions, ", "))
+	}
+	return nil
+}
+
+func writeBenchBaseline(filename string, baseline benchResults) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return wraperr(err, "cannot create benchmark baseline %s", filename)
+	}
+	return multiErr([]error{baseline.write(f), f.Close()})
+}
+
+func (b benchResults) sortedDirs() []string {
+	ret := make([]string, 0, len(b))
+	for dir := range b {
+		ret = append(ret, dir)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedBenchmarks(benchmarks map[string]map[string][]float64) []string {
+	ret := make([]string, 0, len(benchmarks))
+	for name := range benchmarks {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedUnits(units map[string][]float64) []string {
+	ret := make([]string, 0, len(units))
+	for unit := range units {
+		ret = append(ret, unit)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
-	"io"
+	"bytes"
+	"fmt"
 	"os/exec"
 
 	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
 )
 
 type cmdBuild struct {
-	dirs  []string
-	cache *templateCache
+	dirs     []string
+	cache    *templateCache
+	workers  int
+	budget   workerBudget
+	failFast bool
+	results  *resultCache
 
 	verboseLog logger
 	errorLog   logger
@@ -18,40 +23,46 @@ type cmdBuild struct {
 	cmdStderr cmdOutputStreamer
 }
 
+type buildResult struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	err    error
+}
+
 func (c *cmdBuild) Run(ctx context.Context) error {
 	allErrs := make([]error, 0, len(c.dirs))
-	for _, dir := range c.dirs {
-		err := c.buildDir(ctx, dir)
+	results := make([]buildResult, len(c.dirs))
+	runOrdered(c.workers, len(c.dirs), c.failFast, c.budget.limit(func(i int) error {
+		r := &results[i]
+		r.err = c.buildDir(ctx, c.dirs[i], r)
+		return r.err
+	}), func(i int) {
+		dir := c.dirs[i]
+		r := &results[i]
+		err := multiErr([]error{
+			r.err,
+			copyToStreamer(c.cmdStdout, dir, &r.stdout),
+			copyToStreamer(c.cmdStderr, dir, &r.stderr),
+		})
 		if err != nil {
 			c.errorLog.Printf("Error building directory %s: %s", dir, err)
 			allErrs = append(allErrs, err)
 		}
-	}
+	})
 	return multiErr(allErrs)
 }
 
-func (c *cmdBuild) buildDir(ctx context.Context, dir string) error {
-	stdout, err := c.cmdStdout.GetCmdOutput(dir)
-	if err != nil {
-		return wraperr(err, "cannot create stdout output for %s", dir)
-	}
-
-	stderr, err := c.cmdStderr.GetCmdOutput(dir)
-	if err != nil {
-		return wraperr(err, "cannot create stderr output for %s", dir)
-	}
-
-	for _, s := range []io.Closer{stdout, stderr} {
-		defer func(s io.Closer) {
-			logIfErr(s.Close(), c.errorLog, "could not flush build output file")
-		}(s)
-	}
-
+func (c *cmdBuild) buildDir(ctx context.Context, dir string, r *buildResult) error {
 	c.verboseLog.Printf("Building directory %s", dir)
 	tmpl, err := c.cache.loadInDir(dir)
 	if err != nil {
 		return wraperr(err, "cannot load cache for directory %s", dir)
 	}
+	cacheKey, cached := c.results.check(ctx, "build", []string{dir}, tmpl, []string{"go"})
+	if cached {
+		fmt.Fprintf(&r.stdout, "%s: cached pass\n", dir)
+		return nil
+	}
 	buildFlags := tmpl.BuildFlags()
 	cmdName := "go"
 	cmdArgs := make([]string, 0, len(buildFlags)+1)
@@ -59,10 +70,11 @@ func (c *cmdBuild) buildDir(ctx context.Context, dir string) error {
 	cmdArgs = append(cmdArgs, buildFlags...)
 	cmd := exec.Command(cmdName, cmdArgs...)
 	cmd.Dir = dir
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
+	cmd.Stdout = &r.stdout
+	cmd.Stderr = &r.stderr
+	if err := runCmd(ctx, cmd); err != nil {
 		return wraperr(err, "unable to finish running build for %s", dir)
 	}
+	c.results.record(cacheKey, nil)
 	return nil
 }
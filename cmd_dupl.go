@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os/exec"
 	"strings"
 
@@ -13,13 +14,26 @@ import (
 
 type duplCmd struct {
 	verboseLog logger
-	htmlOut    io.Writer
-	consoleOut io.Writer
-	tmpl       *buildTemplate
-	dirs       []string
+	// htmlFilename is only written on a run, so a cached pass keeps the report of the last run
+	htmlFilename string
+	consoleOut   io.Writer
+	tmpl         *buildTemplate
+	dirs         []string
+	results      *resultCache
 }
 
 func (d *duplCmd) Run(ctx context.Context) error {
+	cacheKey, cached := d.results.check(ctx, "dupl", d.dirs, d.tmpl, []string{"dupl"})
+	if cached {
+		_, err := io.WriteString(d.consoleOut, "dupl: cached pass\n")
+		return err
+	}
+	err := d.runUncached(ctx)
+	d.results.record(cacheKey, err)
+	return err
+}
+
+func (d *duplCmd) runUncached(ctx context.Context) error {
 	d.verboseLog.Printf("Running dupl -plumbing command")
 	regDuplOut, err := d.runDupl(ctx, []string{"-plumbing"})
 	if err != nil {
@@ -37,9 +51,8 @@ func (d *duplCmd) Run(ctx context.Context) error {
 	if err != nil {
 		return wraperr(err, "could not copy dupl output, wrote %d", n)
 	}
-	n, err = d.htmlOut.Write(htmlDuplOut)
-	if err != nil {
-		return wraperr(err, "could not copy html dupl output, wrote %d", n)
+	if err := ioutil.WriteFile(d.htmlFilename, htmlDuplOut, 0644); err != nil {
+		return wraperr(err, "could not write html dupl output to %s", d.htmlFilename)
 	}
 	if len(regDuplOut) > 2 {
 		return errDuplicatesDetected
@@ -63,5 +76,5 @@ func (d *duplCmd) runDupl(ctx context.Context, extraArgs []string) ([]byte, erro
 	}
 	cmd := exec.Command(cmdName, args...)
 	cmd.Stdin = &buf
-	return cmd.CombinedOutput()
+	return combinedOutput(ctx, cmd)
 }
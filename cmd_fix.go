@@ -21,17 +21,17 @@ func (f *fixCmd) Run(ctx context.Context) error {
 		return wraperr(err, "dupl *.go glob search failed for %s", strings.Join(f.dirs, ", "))
 	}
 
-	if err := f.fmtCmd("gofmt", []string{"-s", "-w"}, goFiles); err != nil {
+	if err := f.fmtCmd(ctx, "gofmt", []string{"-s", "-w"}, goFiles); err != nil {
 		return wraperr(err, "cannot gofmt correctly")
 	}
 	return nil
 }
 
-func (f *fixCmd) fmtCmd(cmdName string, args []string, goFiles []string) error {
+func (f *fixCmd) fmtCmd(ctx context.Context, cmdName string, args []string, goFiles []string) error {
 	for _, chunk := range chunkStrings(goFiles, f.chunkSize) {
 		f.verboseOut.Printf("running %s on %s", cmdName, strings.Join(chunk, ", "))
 		cmd := exec.Command(cmdName, append(args, chunk...)...)
-		bout, err := cmd.CombinedOutput()
+		bout, err := combinedOutput(ctx, cmd)
 		if err != nil {
 			return wraperr(err, "unable to run %s correctly", cmdName)
 		}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// fuzzTargetOff is the budget that disables a fuzz target in [fuzz.targets]
+const fuzzTargetOff = "off"
+
+type fuzzTarget struct {
+	dir      string
+	name     string
+	fuzztime string
+}
+
+type fuzzCmd struct {
+	dirs     []string
+	cache    *templateCache
+	workers  int
+	budget   workerBudget
+	failFast bool
+
+	// crashersDir is where new crashers found by fuzzing are copied to
+	crashersDir string
+
+	verboseLog logger
+	errLog     logger
+
+	cmdStdout cmdOutputStreamer
+	cmdStderr cmdOutputStreamer
+}
+
+// discoverFuzzTargets returns the names of the FuzzXxx(*testing.F) functions in dir's test files
+func discoverFuzzTargets(dir string) ([]string, error) {
+	testFiles, err := filesWithGlobInDir([]string{dir}, "*_test.go")
+	if err != nil {
+		return nil, wraperr(err, "cannot list test files in %s", dir)
+	}
+	fset := token.NewFileSet()
+	ret := make([]string, 0, 4)
+	for _, filename := range testFiles {
+		f, err := parser.ParseFile(fset, filename, nil, 0)
+		if err != nil {
+			return nil, wraperr(err, "cannot parse %s", filename)
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && isFuzzFunc(fn) {
+				ret = append(ret, fn.Name.Name)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func isFuzzFunc(fn *ast.FuncDecl) bool {
+	if fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Fuzz") || len(fn.Type.Params.List) != 1 {
+		return false
+	}
+	star, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "F"
+}
+
+// targets returns every fuzz target to run, with the budget from each directory's template
+func (f *fuzzCmd) targets() ([]fuzzTarget, error) {
+	ret := make([]fuzzTarget, 0, len(f.dirs))
+	for _, dir := range f.dirs {
+		tmpl, err := f.cache.loadInDir(dir)
+		if err != nil {
+			return nil, wraperr(err, "unable to load template for %s", dir)
+		}
+		names, err := discoverFuzzTargets(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			fuzztime := tmpl.Fuzz.Fuzztime
+			if budget := tmpl.Fuzz.Targets[name]; budget != "" {
+				fuzztime = budget
+			}
+			if fuzztime == fuzzTargetOff {
+				f.verboseLog.Printf("Fuzz target %s in %s is off", name, dir)
+				continue
+			}
+			ret = append(ret, fuzzTarget{dir: dir, name: name, fuzztime: fuzztime})
+		}
+	}
+	return ret, nil
+}
+
+type fuzzResult struct {
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	crashers []string
+	err      error
+}
+
+func (f *fuzzCmd) Run(ctx context.Context) error {
+	targets, err := f.targets()
+	if err != nil {
+		return err
+	}
+	allErrs := make([]error, 0, len(targets))
+	results := make([]fuzzResult, len(targets))
+	runOrdered(f.workers, len(targets), f.failFast, f.budget.limit(func(i int) error {
+		results[i].err = f.fuzz(ctx, targets[i], &results[i])
+		return results[i].err
+	}), func(i int) {
+		t := targets[i]
+		r := &results[i]
+		name := t.dir + "_" + t.name
+		err := multiErr([]error{
+			r.err,
+			copyToStreamer(f.cmdStdout, name, &r.stdout),
+			copyToStreamer(f.cmdStderr, name, &r.stderr),
+		})
+		if err != nil {
+			f.errLog.Printf("Fuzz failure on %s %s: %s", t.dir, t.name, err.Error())
+			allErrs = append(allErrs, err)
+		}
+	})
+	return multiErr(allErrs)
+}
+
+func (f *fuzzCmd) fuzz(ctx context.Context, t fuzzTarget, r *fuzzResult) error {
+	corpusDir := filepath.Join(t.dir, "testdata", "fuzz", t.name)
+	before, err := listFiles(corpusDir)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("go", "test", "-run", "^$", "-fuzz", "^"+t.name+"$", "-fuzztime", t.fuzztime, ".")
+	cmd.Dir = t.dir
+	cmd.Stdout = &r.stdout
+	cmd.Stderr = &r.stderr
+	f.verboseLog.Printf("Running [cmd=%s args=%s dir=%s]", cmd.Path, strings.Join(cmd.Args, " "), cmd.Dir)
+	runErr := runCmd(ctx, cmd)
+
+	after, err := listFiles(corpusDir)
+	if err != nil {
+		return multiErr([]error{runErr, err})
+	}
+	for name := range after {
+		if _, existed := before[name]; existed {
+			continue
+		}
+		dst := filepath.Join(f.crashersDir, sanitizeFilename(t.dir), t.name, name)
+		if err := copyFile(filepath.Join(corpusDir, name), dst); err != nil {
+			return multiErr([]error{runErr, err})
+		}
+		r.crashers = append(r.crashers, dst)
+	}
+	if len(r.crashers) > 0 {
+		return fmt.Errorf("fuzz target %s in %s found crashers: %s", t.name, t.dir, strings.Join(r.crashers, ", "))
+	}
+	if runErr != nil {
+		return wraperr(runErr, "fuzz target %s failed in %s", t.name, t.dir)
+	}
+	return nil
+}
+
+// listFiles returns the names of the files in dir, which may not exist
+func listFiles(dir string) (map[string]struct{}, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string]struct{}{}, nil
+	}
+	if err != nil {
+		return nil, wraperr(err, "cannot list %s", dir)
+	}
+	ret := make(map[string]struct{}, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			ret[info.Name()] = struct{}{}
+		}
+	}
+	return ret, nil
+}
+
+func copyFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return wraperr(err, "cannot create directory for %s", dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return wraperr(err, "cannot open %s", src)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return multiErr([]error{wraperr(err, "cannot create %s", dst), in.Close()})
+	}
+	_, err = io.Copy(out, in)
+	return multiErr([]error{err, in.Close(), out.Close()})
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 
+	"os/exec"
 	"strings"
-
-	"bufio"
+	"sync"
+	"time"
 
 	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
 	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
@@ -17,108 +18,253 @@ import (
 type goCoverageCheck struct {
 	dirs               []string
 	cache              *templateCache
+	workers            int
+	budget             workerBudget
+	failFast           bool
 	coverProfileOutTo  cmdOutputStreamer
 	testStdoutOutputTo cmdOutputStreamer
 	testStderrOutputTo cmdOutputStreamer
 	verboseLog         logger
 	errLog             logger
 
+	summaryOut          io.Writer
 	fullCoverageOutput  io.Writer
 	aggregateTestStdout io.Writer
+	testEventsOutput    io.Writer
+	slowTestsOutput     io.Writer
+	racesOutput         io.Writer
+
+	// crashDumpPrefix starts the name of the file each package's panic or timeout is saved to
+	crashDumpPrefix string
+
+	// timings is filled in with how long each directory took to test
+	timings testTimings
+	// integration runs tests with the [integration] section of each directory's template
+	integration bool
+
+	// requiredCoverage is the testCoverage for the merged profile of packages tested with coverpkg
+	requiredCoverage float64
+
+	modulePatternMu sync.Mutex
+	modulePattern   string
+}
+
+// testArgs are the go test flags for dir, before -coverprofile and the package
+func (g *goCoverageCheck) testArgs(tmpl *buildTemplate) []string {
+	if g.integration {
+		return tmpl.IntegrationArgs()
+	}
+	return append([]string{}, tmpl.TestCoverageArgs()...)
+}
+
+// testEnv is added to the environment of go test
+func (g *goCoverageCheck) testEnv(tmpl *buildTemplate) []string {
+	if g.integration {
+		return tmpl.IntegrationEnv()
+	}
+	return nil
+}
+
+type testResult struct {
+	coverageFilename string
+	stdout           bytes.Buffer
+	stderr           bytes.Buffer
+	events           []testEvent
+	flaky            []string
+	quarantined      []string
+	slow             []string
+	coverpkg         bool
+	duration         time.Duration
+	err              error
 }
 
 func (g *goCoverageCheck) Run(ctx context.Context) error {
 	allErrs := make([]error, 0, len(g.dirs))
 	allCoverProfiles := make([]string, 0, len(g.dirs))
-	for _, d := range g.dirs {
-		g.verboseLog.Printf("Running test %s", d)
-		coverageFilename, err := g.runForDir(d)
-		if err != nil {
-			g.errLog.Printf("Test failure on %s: %s", d, err.Error())
+	results := make([]testResult, len(g.dirs))
+	summary := testSummary{}
+	slow := slowReport{}
+	races := raceReport{}
+	anyCoverpkg := false
+	runOrdered(g.workers, len(g.dirs), g.failFast, g.budget.limit(func(i int) error {
+		r := &results[i]
+		g.verboseLog.Printf("Running test %s", g.dirs[i])
+		start := time.Now()
+		r.coverageFilename, r.err = g.runForDir(ctx, g.dirs[i], r)
+		r.duration = time.Since(start)
+		return r.err
+	}), func(i int) {
+		d := g.dirs[i]
+		r := &results[i]
+		if _, err := g.aggregateTestStdout.Write(r.stdout.Bytes()); err != nil {
+			allErrs = append(allErrs, wraperr(err, "cannot write aggregate test output for %s", d))
+		}
+		if g.timings != nil && ctx.Err() == nil {
+			g.timings[d] = r.duration.Seconds()
+		}
+		if err := writeTestEvents(g.testEventsOutput, r.events); err != nil {
+			allErrs = append(allErrs, wraperr(err, "cannot write test events for %s", d))
+		}
+		if err := multiErr([]error{copyToStreamer(g.testStdoutOutputTo, d, &r.stdout), copyToStreamer(g.testStderrOutputTo, d, &r.stderr)}); err != nil {
 			allErrs = append(allErrs, err)
 		}
-		if coverageFilename != "" {
-			allCoverProfiles = append(allCoverProfiles, coverageFilename)
+		if r.err != nil {
+			g.errLog.Printf("Test failure on %s: %s", d, r.err.Error())
+			allErrs = append(allErrs, r.err)
 		}
+		if r.coverageFilename != "" {
+			allCoverProfiles = append(allCoverProfiles, r.coverageFilename)
+		}
+		anyCoverpkg = anyCoverpkg || r.coverpkg
+		summary.add(d, r)
+		slow.add(packagesFromEvents(r.events))
+		races.add(racesFromEvents(r.events))
+	})
+	if err := summary.write(g.summaryOut); err != nil {
+		allErrs = append(allErrs, wraperr(err, "cannot write test summary"))
+	}
+	if err := multiErr([]error{races.write(g.summaryOut), races.writeJSON(g.racesOutput)}); err != nil {
+		allErrs = append(allErrs, wraperr(err, "cannot write data races"))
+	}
+	if err := multiErr([]error{slow.write(g.summaryOut, slowReportSize), slow.write(g.slowTestsOutput, slowReportSize)}); err != nil {
+		allErrs = append(allErrs, err)
 	}
 
-	if err := g.combineCoverageProfiles(allCoverProfiles); err != nil {
+	profiles, err := g.combineCoverageProfiles(allCoverProfiles)
+	if err != nil {
 		allErrs = append(allErrs, err)
+	} else if anyCoverpkg {
+		// Packages measured with coverpkg cover each other, so only the merged total is meaningful
+		coverage := profileCoverage(profiles)
+		if coverage+.001 < g.requiredCoverage {
+			allErrs = append(allErrs, fmt.Errorf("total code coverage %f < required %f", coverage, g.requiredCoverage))
+		}
+		g.verboseLog.Printf("Compared total coverage %f vs %f", coverage, g.requiredCoverage)
 	}
 	return multiErr(allErrs)
 }
 
+// testSummary collects what is printed after every directory has been tested
+type testSummary struct {
+	flaky       []string
+	quarantined []string
+	slow        []string
+}
+
+func (s *testSummary) add(dir string, r *testResult) {
+	for _, f := range r.flaky {
+		s.flaky = append(s.flaky, fmt.Sprintf("%s: %s", dir, f))
+	}
+	for _, q := range r.quarantined {
+		s.quarantined = append(s.quarantined, fmt.Sprintf("%s: %s", dir, q))
+	}
+	for _, t := range r.slow {
+		s.slow = append(s.slow, fmt.Sprintf("%s: %s", dir, t))
+	}
+}
+
+func (s *testSummary) write(w io.Writer) error {
+	lines := make([]string, 0, len(s.flaky)+len(s.quarantined)+len(s.slow)+3)
+	if len(s.flaky) > 0 {
+		lines = append(lines, "flaky tests:")
+		for _, f := range s.flaky {
+			lines = append(lines, "  "+f)
+		}
+	}
+	if len(s.quarantined) > 0 {
+		lines = append(lines, "quarantined test failures:")
+		for _, q := range s.quarantined {
+			lines = append(lines, "  "+q)
+		}
+	}
+	if len(s.slow) > 0 {
+		lines = append(lines, "slow tests:")
+		for _, t := range s.slow {
+			lines = append(lines, "  "+t)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
 type hasName interface {
 	Name() string
 }
 
 var _ hasName = &os.File{}
 
-func writeLine(w io.Writer, line string) error {
-	if _, err := io.WriteString(w, line); err != nil {
-		return wraperr(err, "cannot write to coverprofile")
-	}
-	if _, err := io.WriteString(w, "\n"); err != nil {
-		return wraperr(err, "cannot write to coverprofile")
+func (g *goCoverageCheck) combineCoverageProfiles(filenames []string) ([]*cover.Profile, error) {
+	profiles, err := mergeCoverageFiles(filenames)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return profiles, writeProfiles(g.fullCoverageOutput, profiles)
 }
 
-func (g *goCoverageCheck) combineCoverageProfiles(filenames []string) error {
-	writtenHead := false
-	for _, filename := range filenames {
-		f, err := os.Open(filename)
+// coverpkgArgs returns the -coverpkg flag for the template's coverpkg setting, if any
+func (g *goCoverageCheck) coverpkgArgs(ctx context.Context, tmpl *buildTemplate) ([]string, error) {
+	patterns := tmpl.CoverPackages()
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	for i, p := range patterns {
+		if p != coverpkgModule {
+			continue
+		}
+		modulePattern, err := g.loadModulePattern(ctx)
 		if err != nil {
-			return wraperr(err, "cannot open file %s", filename)
-		}
-		s := bufio.NewScanner(f)
-		for s.Scan() {
-			curLine := s.Text()
-			if strings.HasPrefix(curLine, "mode:") {
-				if !writtenHead {
-					if err := writeLine(g.fullCoverageOutput, curLine); err != nil {
-						return wraperr(err, "cannot write to coverprofile")
-					}
-					writtenHead = true
-				}
-				continue
-			}
-			if err := writeLine(g.fullCoverageOutput, curLine); err != nil {
-				return wraperr(err, "cannot write to coverprofile")
-			}
+			return nil, err
 		}
-		if err := f.Close(); err != nil {
-			return wraperr(err, "cannot close coverprofile file %s", filename)
+		patterns[i] = modulePattern
+	}
+	return []string{"-coverpkg", strings.Join(patterns, ",")}, nil
+}
+
+// loadModulePattern returns the package pattern for the module of the current directory, or its
+// GOPATH import path outside of module mode
+func (g *goCoverageCheck) loadModulePattern(ctx context.Context) (string, error) {
+	g.modulePatternMu.Lock()
+	defer g.modulePatternMu.Unlock()
+	if g.modulePattern != "" {
+		return g.modulePattern, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", "list", "-m", "-f", "{{.Path}}")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := runCmd(ctx, cmd); err != nil {
+		g.verboseLog.Printf("Not in module mode (%s), using the import path of the current directory", strings.TrimSpace(stderr.String()))
+		stdout.Reset()
+		stderr.Reset()
+		// -e prints the import path even if the directory has no go files of its own
+		cmd = exec.Command("go", "list", "-e", "-f", "{{.ImportPath}}", ".")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := runCmd(ctx, cmd); err != nil {
+			return "", wraperr(err, "cannot find the module or import path for coverpkg: %s", strings.TrimSpace(stderr.String()))
 		}
 	}
-	return nil
+	g.modulePattern = strings.TrimSpace(stdout.String()) + "/..."
+	return g.modulePattern, nil
 }
 
-func (g *goCoverageCheck) runForDir(dir string) (string, error) {
+func (g *goCoverageCheck) runForDir(ctx context.Context, dir string, r *testResult) (string, error) {
 	template, err := g.cache.loadInDir(dir)
 	if err != nil {
 		return "", wraperr(err, "unable to load cache for %s", dir)
 	}
-	coverArgs := append([]string{"test", "-v"}, template.TestCoverageArgs()...)
-	cmdName := "go"
-	coverprofile, err := g.coverProfileOutTo.GetCmdOutput(dir)
-	if err != nil {
-		return "", wraperr(err, "coverprofile generation failed for %s", dir)
-	}
-	stdout, err := g.testStdoutOutputTo.GetCmdOutput(dir)
+	coverArgs := g.testArgs(template)
+	coverpkgArgs, err := g.coverpkgArgs(ctx, template)
 	if err != nil {
-		return "", wraperr(err, "stdout generation failed for %s", dir)
+		return "", err
 	}
-	stderr, err := g.testStderrOutputTo.GetCmdOutput(dir)
+	r.coverpkg = len(coverpkgArgs) > 0
+	coverArgs = append(coverArgs, coverpkgArgs...)
+	coverprofile, err := g.coverProfileOutTo.GetCmdOutput(dir)
 	if err != nil {
-		return "", wraperr(err, "stderr generation failed for %s", dir)
-	}
-	for _, s := range []io.Closer{stdout, stderr} {
-		defer func(s io.Closer) {
-			logIfErr(s.Close(), g.errLog, "could not flush test output file")
-		}(s)
+		return "", wraperr(err, "coverprofile generation failed for %s", dir)
 	}
-
 	// Note: this panics if the coverprofile doesn't return File types
 	coverprofileName := coverprofile.(hasName).Name()
 	coverArgs = append(coverArgs, "-coverprofile", coverprofileName, ".")
@@ -127,16 +273,21 @@ func (g *goCoverageCheck) runForDir(dir string) (string, error) {
 		return "", wraperr(err, "unable to generate coverprofile file")
 	}
 
-	cmd := exec.Command(cmdName, coverArgs...)
-	cmd.Stdout = io.MultiWriter(stdout, g.aggregateTestStdout)
-	cmd.Stderr = stderr
-	cmd.Dir = dir
-	g.verboseLog.Printf("Running [cmd=%s args=%s dir=%s]", cmd.Path, strings.Join(cmd.Args, " "), cmd.Dir)
-	err = cmd.Run()
+	r.events, err = g.runGoTest(ctx, dir, coverArgs, g.testEnv(template), &r.stdout, &r.stderr)
 	if err != nil {
-		return coverprofileName, wraperr(err, "test failed for %s", dir)
+		if err := g.retryFailures(ctx, dir, template, coverprofileName, r, err); err != nil {
+			// Slow tests are still reported, since they often explain a failure or timeout
+			return coverprofileName, multiErr([]error{wraperr(g.explainCrash(r, err), "test failed for %s", dir), checkSlowTests(dir, template, r)})
+		}
+	}
+	if err := checkSlowTests(dir, template, r); err != nil {
+		return coverprofileName, err
 	}
 
+	if r.coverpkg {
+		g.verboseLog.Printf("Checking coverage of %s in the merged profile, since it uses coverpkg", dir)
+		return coverprofileName, nil
+	}
 	coverage, err := calculateCoverage(coverprofileName)
 	if err != nil {
 		return coverprofileName, wraperr(err, "unable to calculate coverage")
@@ -157,6 +308,11 @@ func calculateCoverage(coverprofile string) (float64, error) {
 		}
 		return 0.0, wraperr(err, "cannot parse coverage profile file %s", coverprofile)
 	}
+	return profileCoverage(profiles), nil
+}
+
+// profileCoverage is the percent of statements in profiles that ran
+func profileCoverage(profiles []*cover.Profile) float64 {
 	total := 0
 	covered := 0
 	for _, profile := range profiles {
@@ -168,7 +324,7 @@ func calculateCoverage(coverprofile string) (float64, error) {
 		}
 	}
 	if total == 0 {
-		return 0.0, nil
+		return 0.0
 	}
-	return float64(covered) / float64(total) * 100, nil
+	return float64(covered) / float64(total) * 100
 }
@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
 
 	"errors"
 
@@ -20,35 +21,60 @@ type gometalinterCmd struct {
 	metaOutput cmdOutputStreamer
 	dirsToLint []string
 	cache      *templateCache
+	workers    int
+	budget     workerBudget
+	failFast   bool
+	results    *resultCache
 
 	regexParseCache map[string]*regexp.Regexp
+	regexMu         sync.Mutex
 }
 
 var errLintFailures = errors.New("gometalinter failures found")
 
+type lintResult struct {
+	failedLines []string
+	cached      bool
+	err         error
+}
+
 func (l *gometalinterCmd) Run(ctx context.Context) error {
 	if l.regexParseCache == nil {
 		l.regexParseCache = make(map[string]*regexp.Regexp, 10)
 	}
 	allFailures := make([]string, 0, len(l.dirsToLint))
-	for _, dir := range l.dirsToLint {
-		tmpl, err := l.cache.loadInDir(dir)
-		if err != nil {
-			return wraperr(err, "unable to load template for %s", dir)
+	results := make([]lintResult, len(l.dirsToLint))
+	var firstErr error
+	runOrdered(l.workers, len(l.dirsToLint), l.failFast, l.budget.limit(func(i int) error {
+		results[i].failedLines, results[i].cached, results[i].err = l.lintDir(ctx, l.dirsToLint[i])
+		if results[i].err == nil && len(results[i].failedLines) > 0 {
+			return errLintFailures
 		}
-		failedLines, err := l.lintInDir(dir, tmpl)
-		if err != nil {
-			return wraperr(err, "unable to parse gometalinter lines")
+		return results[i].err
+	}), func(i int) {
+		if firstErr != nil {
+			return
+		}
+		dir := l.dirsToLint[i]
+		if results[i].err != nil {
+			firstErr = results[i].err
+			return
 		}
-		dataParts := make([]string, 0, len(failedLines))
-		for _, line := range failedLines {
+		dataParts := make([]string, 0, len(results[i].failedLines))
+		for _, line := range results[i].failedLines {
 			errStr := fmt.Sprintf("%s/%s", dir, line)
 			dataParts = append(dataParts, errStr)
 		}
 		allFailures = append(allFailures, dataParts...)
+		if results[i].cached {
+			dataParts = append(dataParts, fmt.Sprintf("%s: cached pass", dir))
+		}
 		if err := l.parseRunOutput(ctx, dir, dataParts); err != nil {
-			return wraperr(err, "cannot parse metalinter output")
+			firstErr = wraperr(err, "cannot parse metalinter output")
 		}
+	})
+	if firstErr != nil {
+		return firstErr
 	}
 	if len(allFailures) == 0 {
 		return nil
@@ -56,6 +82,36 @@ func (l *gometalinterCmd) Run(ctx context.Context) error {
 	return errLintFailures
 }
 
+func (l *gometalinterCmd) lintDir(ctx context.Context, dir string) ([]string, bool, error) {
+	tmpl, err := l.cache.loadInDir(dir)
+	if err != nil {
+		return nil, false, wraperr(err, "unable to load template for %s", dir)
+	}
+	cacheKey, cached := l.results.check(ctx, "lint", []string{dir}, tmpl, lintTools(tmpl))
+	if cached {
+		return nil, true, nil
+	}
+	failedLines, err := l.lintInDir(ctx, dir, tmpl)
+	if err != nil {
+		return nil, false, wraperr(err, "unable to parse gometalinter lines")
+	}
+	if len(failedLines) == 0 {
+		l.results.record(cacheKey, nil)
+	}
+	return failedLines, false, nil
+}
+
+// lintTools returns the binaries whose versions can change the lint result for tmpl
+func lintTools(tmpl *buildTemplate) []string {
+	ret := []string{"gometalinter"}
+	for linterName, enabled := range tmpl.Metalinter.Enabled {
+		if enabled {
+			ret = append(ret, linterName)
+		}
+	}
+	return ret
+}
+
 func (l *gometalinterCmd) parseRunOutput(ctx context.Context, dir string, dataParts []string) error {
 	dst, err := l.metaOutput.GetCmdOutput(dir)
 	if err != nil {
@@ -85,6 +141,8 @@ func sanitizeFilename(s string) string {
 }
 
 func (l *gometalinterCmd) parseRegexes(reg []string) ([]*regexp.Regexp, error) {
+	l.regexMu.Lock()
+	defer l.regexMu.Unlock()
 	ret := make([]*regexp.Regexp, 0, len(reg))
 	for _, g := range reg {
 		if r, exists := l.regexParseCache[g]; exists {
@@ -110,12 +168,12 @@ func matchesAny(toMatch []byte, reg []*regexp.Regexp) bool {
 	return false
 }
 
-func (l *gometalinterCmd) lintInDir(dir string, tmpl *buildTemplate) ([]string, error) {
+func (l *gometalinterCmd) lintInDir(ctx context.Context, dir string, tmpl *buildTemplate) ([]string, error) {
 	cmd := exec.Command("gometalinter")
 	cmd.Dir = dir
 	cmd.Args = tmpl.MetalintArgs()
 	l.verboseLog.Printf("Running command %v", cmd)
-	out, err := cmd.CombinedOutput()
+	out, err := combinedOutput(ctx, cmd)
 	if err != nil {
 		l.verboseLog.Printf("Error running metalinter.  We usually ignore errors anyways: %s %s", err.Error(), string(out))
 	}
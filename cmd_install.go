@@ -40,7 +40,7 @@ func (i *installCmd) Run(ctx context.Context) error {
 
 	cmd.Stdout = i.stdoutOutput
 	cmd.Stderr = i.stderrOutput
-	if err := cmd.Run(); err != nil {
+	if err := runCmd(ctx, cmd); err != nil {
 		return wraperr(err, "Unable to run go get")
 	}
 	return nil
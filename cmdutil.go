@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// runCmd runs cmd to completion, killing its whole process group if ctx ends first
+func runCmd(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return wraperr(err, "not starting %s", cmd.Path)
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waitDone := make(chan struct{})
+	killed := make(chan struct{})
+	go func() {
+		defer close(killed)
+		select {
+		case <-ctx.Done():
+			// Errors here mean the process group already exited
+			_ = killProcessGroup(cmd)
+		case <-waitDone:
+		}
+	}()
+	err := cmd.Wait()
+	close(waitDone)
+	<-killed
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return wraperr(ctxErr, "%s killed", cmd.Path)
+	}
+	return err
+}
+
+// combinedOutput is exec.Cmd.CombinedOutput that honors ctx like runCmd
+func combinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	err := runCmd(ctx, cmd)
+	return b.Bytes(), err
+}
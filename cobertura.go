@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
+)
+
+const coberturaDocType = `<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`
+
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        string             `xml:"line-rate,attr"`
+	BranchRate      string             `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      string             `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   string           `xml:"line-rate,attr"`
+	BranchRate string           `xml:"branch-rate,attr"`
+	Complexity string           `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   string          `xml:"line-rate,attr"`
+	BranchRate string          `xml:"branch-rate,attr"`
+	Complexity string          `xml:"complexity,attr"`
+	Methods    struct{}        `xml:"methods"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int `xml:"number,attr"`
+	Hits   int `xml:"hits,attr"`
+}
+
+// lineCounts tallies the lines of a report and how many of them ran
+type lineCounts struct {
+	covered int
+	valid   int
+}
+
+func (l *lineCounts) add(other lineCounts) {
+	l.covered += other.covered
+	l.valid += other.valid
+}
+
+func (l lineCounts) rate() string {
+	if l.valid == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.4f", float64(l.covered)/float64(l.valid))
+}
+
+// coberturaLines gives every line in a block of p the most hits of any block it is in, since the
+// end of one block and the start of the next often share a line
+func coberturaLines(p *cover.Profile) ([]coberturaLine, lineCounts) {
+	hits := make(map[int]int)
+	for _, b := range p.Blocks {
+		for line := b.StartLine; line <= b.EndLine; line++ {
+			if count, exists := hits[line]; !exists || b.Count > count {
+				hits[line] = b.Count
+			}
+		}
+	}
+	ret := make([]coberturaLine, 0, len(hits))
+	counts := lineCounts{}
+	for line, count := range hits {
+		ret = append(ret, coberturaLine{Number: line, Hits: count})
+		counts.valid++
+		if count > 0 {
+			counts.covered++
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Number < ret[j].Number
+	})
+	return ret, counts
+}
+
+// newCobertura converts cover profiles to a Cobertura report with one class per file.  File names
+// are relative to source when fileDirs has the file's package directory under it, and import
+// paths otherwise.
+func newCobertura(profiles []*cover.Profile, fileDirs map[string]string, source string, now time.Time) coberturaCoverage {
+	ret := coberturaCoverage{
+		BranchRate: "0",
+		Complexity: "0",
+		Timestamp:  now.UnixNano() / int64(time.Millisecond),
+		Sources:    []string{source},
+	}
+	total := lineCounts{}
+	byPackage := make(map[string]*coberturaPackage, len(profiles))
+	pkgCounts := make(map[string]*lineCounts, len(profiles))
+	for _, p := range profiles {
+		importPath := path.Dir(p.FileName)
+		pkg, exists := byPackage[importPath]
+		if !exists {
+			pkg = &coberturaPackage{Name: importPath, BranchRate: "0", Complexity: "0"}
+			byPackage[importPath] = pkg
+			pkgCounts[importPath] = &lineCounts{}
+		}
+		filename := p.FileName
+		if dir, exists := fileDirs[importPath]; exists {
+			if rel, err := filepath.Rel(source, realPath(filepath.Join(dir, path.Base(p.FileName)))); err == nil && !outsideDir(rel) {
+				filename = filepath.ToSlash(rel)
+			}
+		}
+		lines, counts := coberturaLines(p)
+		pkg.Classes = append(pkg.Classes, coberturaClass{
+			Name:       path.Base(p.FileName),
+			Filename:   filename,
+			LineRate:   counts.rate(),
+			BranchRate: "0",
+			Complexity: "0",
+			Lines:      lines,
+		})
+		pkgCounts[importPath].add(counts)
+		total.add(counts)
+	}
+	for name, pkg := range byPackage {
+		pkg.LineRate = pkgCounts[name].rate()
+		ret.Packages = append(ret.Packages, *pkg)
+	}
+	sort.Slice(ret.Packages, func(i, j int) bool {
+		return ret.Packages[i].Name < ret.Packages[j].Name
+	})
+	ret.LineRate = total.rate()
+	ret.LinesCovered = total.covered
+	ret.LinesValid = total.valid
+	return ret
+}
+
+func writeCobertura(w io.Writer, c coberturaCoverage) error {
+	if _, err := io.WriteString(w, xml.Header+coberturaDocType+"\n"); err != nil {
+		return wraperr(err, "cannot write cobertura XML header")
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(c); err != nil {
+		return wraperr(err, "cannot encode cobertura XML")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// outsideDir is true if the relative path rel leaves the directory it is relative to.  Names that
+// only start with dots, like "..foo/a.go", are still inside it.
+func outsideDir(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
+)
+
+// coverageBaseline is the coverage percent of each package and of every package together
+type coverageBaseline struct {
+	Total    float64            `json:"total"`
+	Packages map[string]float64 `json:"packages"`
+}
+
+// newCoverageBaseline computes coverage from a merged cover profile.  Profile file names are
+// import paths, so a file's package is its directory.
+func newCoverageBaseline(profiles []*cover.Profile) *coverageBaseline {
+	byPackage := make(map[string][]*cover.Profile, len(profiles))
+	for _, p := range profiles {
+		pkg := path.Dir(p.FileName)
+		byPackage[pkg] = append(byPackage[pkg], p)
+	}
+	ret := &coverageBaseline{
+		Total:    profileCoverage(profiles),
+		Packages: make(map[string]float64, len(byPackage)),
+	}
+	for pkg, p := range byPackage {
+		ret.Packages[pkg] = profileCoverage(p)
+	}
+	return ret
+}
+
+// loadCoverageBaseline reads a baseline written by write.  A missing file is an empty baseline.
+func loadCoverageBaseline(filename string) (*coverageBaseline, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &coverageBaseline{Packages: map[string]float64{}}, nil
+	}
+	if err != nil {
+		return nil, wraperr(err, "cannot open coverage baseline %s", filename)
+	}
+	ret := &coverageBaseline{}
+	err = json.NewDecoder(f).Decode(ret)
+	if err := multiErr([]error{err, f.Close()}); err != nil {
+		return nil, wraperr(err, "cannot decode coverage baseline %s", filename)
+	}
+	if ret.Packages == nil {
+		ret.Packages = map[string]float64{}
+	}
+	return ret, nil
+}
+
+func (c *coverageBaseline) write(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return wraperr(err, "cannot create coverage baseline %s", filename)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return multiErr([]error{enc.Encode(c), f.Close()})
+}
+
+// drops lists the packages, and with withTotal the total, whose coverage fell more than tolerance
+// percent below baseline.  Packages missing from either side are not compared.  The total is only
+// comparable when every package was tested.
+func (c *coverageBaseline) drops(baseline *coverageBaseline, tolerance float64, withTotal bool) []string {
+	ret := make([]string, 0, 2)
+	pkgs := make([]string, 0, len(c.Packages))
+	for pkg := range c.Packages {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		before, exists := baseline.Packages[pkg]
+		if exists && c.Packages[pkg]+tolerance < before {
+			ret = append(ret, fmt.Sprintf("%s: %.1f%% < baseline %.1f%%", pkg, c.Packages[pkg], before))
+		}
+	}
+	if withTotal && len(c.Packages) > 0 && len(baseline.Packages) > 0 && c.Total+tolerance < baseline.Total {
+		ret = append(ret, fmt.Sprintf("total: %.1f%% < baseline %.1f%%", c.Total, baseline.Total))
+	}
+	return ret
+}
+
+// ratchet raises baseline to this run's coverage wherever it went up, so the baseline never drops.
+// The total is only raised withTotal.
+func (c *coverageBaseline) ratchet(baseline *coverageBaseline, withTotal bool) *coverageBaseline {
+	ret := &coverageBaseline{
+		Total:    baseline.Total,
+		Packages: make(map[string]float64, len(baseline.Packages)+len(c.Packages)),
+	}
+	for pkg, coverage := range baseline.Packages {
+		ret.Packages[pkg] = coverage
+	}
+	for pkg, coverage := range c.Packages {
+		if before, exists := ret.Packages[pkg]; !exists || coverage > before {
+			ret.Packages[pkg] = coverage
+		}
+	}
+	if withTotal && c.Total > ret.Total {
+		ret.Total = c.Total
+	}
+	return ret
+}
+
+// compareCoverageBaseline checks the merged cover profile coverageFilename against the baseline
+// file.  With update, the baseline is ratcheted up and drops are printed without failing.  The
+// total is skipped unless allPackages, since a run of some packages has a different total.
+func compareCoverageBaseline(coverageFilename string, baselineFilename string, tolerance float64, allPackages bool, update bool, summaryOut io.Writer) error {
+	profiles, err := cover.ParseProfiles(coverageFilename)
+	if err != nil {
+		return wraperr(err, "cannot parse coverage profile file %s", coverageFilename)
+	}
+	current := newCoverageBaseline(profiles)
+	baseline, err := loadCoverageBaseline(baselineFilename)
+	if err != nil {
+		return err
+	}
+	drops := current.drops(baseline, tolerance, allPackages)
+	for _, d := range drops {
+		if _, err := fmt.Fprintf(summaryOut, "coverage dropped: %s\n", d); err != nil {
+			return wraperr(err, "cannot write coverage drops")
+		}
+	}
+	if update {
+		return current.ratchet(baseline, allPackages).write(baselineFilename)
+	}
+	if len(drops) > 0 {
+		return fmt.Errorf("coverage dropped more than %.1f%% below %s in %d places", tolerance, baselineFilename, len(drops))
+	}
+	return nil
+}
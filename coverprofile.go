@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
+)
+
+// blockPosition identifies a block of a file across cover profiles
+type blockPosition struct {
+	startLine, startCol, endLine, endCol int
+}
+
+// mergeProfiles combines cover profiles of the same mode.  A block in more than one profile has
+// its counts summed, or OR-ed for set mode, so blocks measured by several test runs are only counted once.
+func mergeProfiles(profiles []*cover.Profile) ([]*cover.Profile, error) {
+	mode := ""
+	byFile := make(map[string]*cover.Profile, len(profiles))
+	blocks := make(map[string]map[blockPosition]int, len(profiles))
+	for _, p := range profiles {
+		if mode == "" {
+			mode = p.Mode
+		} else if p.Mode != mode {
+			return nil, fmt.Errorf("cannot merge coverage profiles of mode %s and %s (%s)", mode, p.Mode, p.FileName)
+		}
+		merged, exists := byFile[p.FileName]
+		if !exists {
+			merged = &cover.Profile{FileName: p.FileName, Mode: p.Mode}
+			byFile[p.FileName] = merged
+			blocks[p.FileName] = make(map[blockPosition]int, len(p.Blocks))
+		}
+		for _, b := range p.Blocks {
+			pos := blockPosition{b.StartLine, b.StartCol, b.EndLine, b.EndCol}
+			idx, exists := blocks[p.FileName][pos]
+			if !exists {
+				blocks[p.FileName][pos] = len(merged.Blocks)
+				merged.Blocks = append(merged.Blocks, b)
+				continue
+			}
+			existing := &merged.Blocks[idx]
+			if existing.NumStmt != b.NumStmt {
+				return nil, fmt.Errorf("inconsistent statement count for block %s:%d.%d in coverage profiles", p.FileName, b.StartLine, b.StartCol)
+			}
+			if mode == "set" {
+				if b.Count > 0 {
+					existing.Count = 1
+				}
+			} else {
+				existing.Count += b.Count
+			}
+		}
+	}
+	ret := make([]*cover.Profile, 0, len(byFile))
+	for _, p := range byFile {
+		sort.Slice(p.Blocks, func(i, j int) bool {
+			bi, bj := p.Blocks[i], p.Blocks[j]
+			return bi.StartLine < bj.StartLine || bi.StartLine == bj.StartLine && bi.StartCol < bj.StartCol
+		})
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].FileName < ret[j].FileName
+	})
+	return ret, nil
+}
+
+// mergeCoverageFiles parses and merges the cover profiles in filenames.  Missing files, from
+// packages that failed to build, are skipped.
+func mergeCoverageFiles(filenames []string) ([]*cover.Profile, error) {
+	all := make([]*cover.Profile, 0, len(filenames))
+	for _, filename := range filenames {
+		profiles, err := cover.ParseProfiles(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, wraperr(err, "cannot parse coverage profile file %s", filename)
+		}
+		all = append(all, profiles...)
+	}
+	merged, err := mergeProfiles(all)
+	if err != nil {
+		return nil, wraperr(err, "cannot merge coverage profiles")
+	}
+	return merged, nil
+}
+
+// profileDirs maps the import path of each package in profiles to its directory
+func profileDirs(ctx context.Context, profiles []*cover.Profile, chunkSize int) (map[string]string, error) {
+	importPaths := make([]string, 0, len(profiles))
+	seen := make(map[string]struct{}, len(profiles))
+	for _, p := range profiles {
+		importPath := path.Dir(p.FileName)
+		if _, exists := seen[importPath]; !exists {
+			seen[importPath] = struct{}{}
+			importPaths = append(importPaths, importPath)
+		}
+	}
+	pkgs, err := listPackagePatterns(ctx, importPaths, chunkSize)
+	if err != nil {
+		return nil, wraperr(err, "cannot find directories of covered packages")
+	}
+	ret := make(map[string]string, len(pkgs))
+	for _, pkg := range pkgs {
+		ret[pkg.ImportPath] = pkg.Dir
+	}
+	return ret, nil
+}
+
+// writeProfiles writes profiles in the go test -coverprofile format
+func writeProfiles(w io.Writer, profiles []*cover.Profile) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "mode: %s\n", profiles[0].Mode); err != nil {
+		return wraperr(err, "cannot write to coverprofile")
+	}
+	for _, p := range profiles {
+		for _, b := range p.Blocks {
+			if _, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", p.FileName, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt, b.Count); err != nil {
+				return wraperr(err, "cannot write to coverprofile")
+			}
+		}
+	}
+	return nil
+}
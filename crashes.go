@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	crashPanic   = "panic"
+	crashTimeout = "timeout"
+
+	// crashFrames is how many stack frames of a crash are shown in the console error
+	crashFrames = 5
+)
+
+var (
+	// timeoutLine looks like "panic: test timed out after 10s"
+	timeoutLine = regexp.MustCompile(`^panic: test timed out after (\S+)$`)
+	// runningTestLine is a test listed under "running tests:" in a timeout, like "		TestHang (10s)"
+	runningTestLine = regexp.MustCompile(`^\t\t(\S+) \(\S+\)$`)
+	// goroutineLine starts each goroutine in a stack dump, like "goroutine 7 [sleep]:"
+	goroutineLine = regexp.MustCompile(`^goroutine \d+ \[.*\]:$`)
+	// frameArgs are the arguments at the end of a stack frame's function
+	frameArgs = regexp.MustCompile(`\([^()]*\)$`)
+)
+
+// testCrash is a panic or timeout that stopped a test binary
+type testCrash struct {
+	kind    string
+	message string
+	// tests were running when the crash happened
+	tests []string
+	// dump is the panic message and every goroutine's stack
+	dump []string
+}
+
+func (c *testCrash) String() string {
+	tests := "tests"
+	if len(c.tests) > 0 {
+		tests = strings.Join(c.tests, ", ")
+	}
+	if c.kind == crashTimeout {
+		return fmt.Sprintf("%s timed out after %s", tests, c.message)
+	}
+	return fmt.Sprintf("%s panicked: %s", tests, c.message)
+}
+
+// crashFromEvents returns the first panic or timeout in events, or nil if there is none
+func crashFromEvents(events []testEvent) *testCrash {
+	var crash *testCrash
+	running := make([]string, 0, 4)
+	inRunningTests := false
+	for _, ev := range events {
+		if crash == nil {
+			switch ev.Action {
+			case "run":
+				running = append(running, ev.Test)
+			case testPass, testFail, testSkip:
+				running = removeString(running, ev.Test)
+			}
+		}
+		if ev.Action != "output" {
+			if crash != nil && ev.Test == "" {
+				// The package finished, so the dump is over
+				break
+			}
+			continue
+		}
+		line := strings.TrimSuffix(ev.Output, "\n")
+		if crash != nil && (packageDoneLine.MatchString(line) || line == "FAIL" || strings.HasPrefix(line, "exit status ")) {
+			break
+		}
+		if crash == nil {
+			if !strings.HasPrefix(line, "panic: ") {
+				continue
+			}
+			crash = &testCrash{kind: crashPanic, message: strings.TrimPrefix(line, "panic: ")}
+			if m := timeoutLine.FindStringSubmatch(line); m != nil {
+				crash.kind = crashTimeout
+				crash.message = m[1]
+			} else if ev.Test != "" {
+				crash.tests = []string{ev.Test}
+			} else {
+				crash.tests = append(crash.tests, running...)
+			}
+		}
+		if line == "\trunning tests:" {
+			inRunningTests = true
+		} else if m := runningTestLine.FindStringSubmatch(line); inRunningTests && m != nil {
+			crash.tests = append(crash.tests, m[1])
+		} else {
+			inRunningTests = false
+		}
+		crash.dump = append(crash.dump, line)
+	}
+	if crash != nil && crash.kind == crashTimeout && len(crash.tests) == 0 {
+		crash.tests = running
+	}
+	return crash
+}
+
+func removeString(strs []string, s string) []string {
+	ret := strs[:0]
+	for _, str := range strs {
+		if str != s {
+			ret = append(ret, str)
+		}
+	}
+	return ret
+}
+
+// goroutineStacks splits a stack dump into each goroutine's frames, as "func file:line"
+func goroutineStacks(dump []string) [][]string {
+	ret := make([][]string, 0, 4)
+	var cur []string
+	for _, line := range dump {
+		switch {
+		case goroutineLine.MatchString(line):
+			ret = append(ret, nil)
+			cur = nil
+		case len(ret) == 0 || line == "":
+		case strings.HasPrefix(line, "\t") && len(cur) > 0:
+			cur[len(cur)-1] += " " + frameOffset.ReplaceAllString(strings.TrimSpace(line), "")
+			ret[len(ret)-1] = cur
+		default:
+			cur = append(cur, frameArgs.ReplaceAllString(line, "()"))
+			ret[len(ret)-1] = cur
+		}
+	}
+	return ret
+}
+
+// topFrames returns the first frames of the goroutine that crashed, leaving out the runtime and
+// testing frames that every crash has.  For timeouts that is the goroutine running the test.
+func (c *testCrash) topFrames(n int) []string {
+	stacks := goroutineStacks(c.dump)
+	if len(stacks) == 0 {
+		return nil
+	}
+	stack := stacks[0]
+	if c.kind == crashTimeout {
+		for _, s := range stacks {
+			if stackRunsTest(s, c.tests) {
+				stack = s
+				break
+			}
+		}
+	}
+	ret := make([]string, 0, n)
+	for _, frame := range stack {
+		if len(ret) == n {
+			break
+		}
+		if strings.HasPrefix(frame, "runtime.") || strings.HasPrefix(frame, "testing.") || strings.HasPrefix(frame, "panic(") || strings.HasPrefix(frame, "created by ") {
+			continue
+		}
+		ret = append(ret, frame)
+	}
+	return ret
+}
+
+func stackRunsTest(stack []string, tests []string) bool {
+	for _, frame := range stack {
+		for _, t := range tests {
+			if strings.Contains(frame, "."+topLevelTest(t)+"() ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// explainCrash saves the stack dump of a panic or timeout in r to a file and adds the crashed test
+// and its top frames to err
+func (g *goCoverageCheck) explainCrash(r *testResult, err error) error {
+	crash := crashFromEvents(r.events)
+	if crash == nil {
+		return err
+	}
+	filename := g.crashDumpPrefix + sanitizeFilename(testPackageName(r.events)) + ".txt"
+	if werr := ioutil.WriteFile(filename, []byte(strings.Join(crash.dump, "\n")+"\n"), 0666); werr != nil {
+		return multiErr([]error{err, wraperr(werr, "cannot write crash dump %s", filename)})
+	}
+	lines := []string{fmt.Sprintf("%s: %s (full dump in %s)", err.Error(), crash, filename)}
+	for _, frame := range crash.topFrames(crashFrames) {
+		lines = append(lines, "\t"+frame)
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
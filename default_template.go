@@ -6,10 +6,41 @@ var defaultTemplate = `
   stopLoadingParent = [".git"]
   buildFlags = ["."]
   testFlags = ["-covermode", "atomic", "-race", "-timeout", "10s", "-cpu", "4", "-parallel", "8"]
+  benchFlags = ["-bench", ".", "-benchmem", "-count", "5"]
   artifactsEnv = "CIRCLE_ARTIFACTS"
   testReportEnv = "CIRCLE_TEST_REPORTS"
+  shardIndexEnv = "CIRCLE_NODE_INDEX"
+  shardTotalEnv = "CIRCLE_NODE_TOTAL"
   duplLimit = "100"
   testCoverage = 0.0
+  coverageTolerance = 0.0
+  patchCoverage = 0.0
+
+[check]
+  phases = ["build", "lint", "dupl", "test"]
+  [check.depends]
+    test = ["build"]
+
+[test]
+  retries = 0
+  slowTestThreshold = "0s"
+  failSlowTests = false
+  coverpkg = ""
+  [test.quarantine]
+
+[bench]
+  threshold = 5.0
+  alpha = 0.05
+
+[fuzz]
+  fuzztime = "30s"
+  parallel = false
+  [fuzz.targets]
+
+[integration]
+  tags = ["integration"]
+  timeout = "10m"
+  [integration.env]
 
 [fix]
   [fix.commands]
@@ -33,7 +64,6 @@ var defaultTemplate = `
   [install.goget]
     gometalinter = "github.com/alecthomas/gometalinter"
     golint = "github.com/golang/lint/golint"
-    go-junit-report = "github.com/jstemmer/go-junit-report"
     goimports = "golang.org/x/tools/cmd/goimports"
     gocyclo = "github.com/alecthomas/gocyclo"
     aligncheck = "github.com/opennota/check/cmd/aligncheck"
@@ -135,6 +135,18 @@ type cmdOutputStreamer interface {
 	GetCmdOutput(cmdName string) (io.WriteCloser, error)
 }
 
+// copyToStreamer writes the buffered output of cmdName to the output s gives for it
+func copyToStreamer(s cmdOutputStreamer, cmdName string, buf *bytes.Buffer) error {
+	out, err := s.GetCmdOutput(cmdName)
+	if err != nil {
+		return wraperr(err, "cannot create output for %s", cmdName)
+	}
+	if _, err := buf.WriteTo(out); err != nil {
+		return multiErr([]error{wraperr(err, "cannot copy output for %s", cmdName), out.Close()})
+	}
+	return out.Close()
+}
+
 func panicIfNotNil(err error, msg string, args ...interface{}) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, msg+"\n", args...)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// hookedCommands are the commands wrapped by withHooks
+var hookedCommands = []string{"build", "lint", "dupl", "test", "bench", "fuzz", "integration", "fix", "install", "check"}
+
+// hookName is the [hooks] key run when ("pre" or "post") cmd runs, like preBuild
+func hookName(when string, cmd string) string {
+	if cmd == "" {
+		return when
+	}
+	return when + strings.ToUpper(cmd[:1]) + cmd[1:]
+}
+
+// validHookNames lists every [hooks] key that runs
+func validHookNames() []string {
+	ret := make([]string, 0, len(hookedCommands)*2)
+	for _, cmd := range hookedCommands {
+		ret = append(ret, hookName("pre", cmd), hookName("post", cmd))
+	}
+	return ret
+}
+
+// hooksFor returns the hooks called name for dirs and the current directory.  A hook from a
+// parent's gobuild.toml is shared by every directory under it, but only runs once.
+func (g *gobuildMain) hooksFor(dirs []string, name string) ([]hook, error) {
+	ret := make([]hook, 0, 2)
+	seen := make(map[string]struct{}, 2)
+	for _, dir := range append([]string{"."}, dirs...) {
+		tmpl, err := g.tc.loadInDir(dir)
+		if err != nil {
+			return nil, wraperr(err, "unable to load template for %s", dir)
+		}
+		for _, h := range tmpl.hooks[name] {
+			key := h.dir + "\x00" + strings.Join(h.args, "\x00")
+			if _, exists := seen[key]; exists {
+				continue
+			}
+			seen[key] = struct{}{}
+			ret = append(ret, h)
+		}
+	}
+	return ret, nil
+}
+
+// runHooks runs hooks in order from the directory they were defined in.  With stopOnError, the
+// first failure stops the remaining hooks.
+func (g *gobuildMain) runHooks(ctx context.Context, name string, hooks []hook, stopOnError bool) error {
+	errs := make([]error, 0, len(hooks))
+	for _, h := range hooks {
+		if len(h.args) == 0 {
+			errs = append(errs, wraperr(errors.New("empty command"), "invalid %s hook in %s", name, h.dir))
+			continue
+		}
+		cmd := exec.Command(h.args[0], h.args[1:]...)
+		cmd.Dir = h.dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		g.verboseLog.Printf("Running %s hook [cmd=%s args=%s dir=%s]", name, cmd.Path, strings.Join(cmd.Args, " "), cmd.Dir)
+		if err := runCmd(ctx, cmd); err != nil {
+			errs = append(errs, wraperr(err, "%s hook %s failed in %s", name, strings.Join(h.args, " "), h.dir))
+			if stopOnError {
+				break
+			}
+		}
+	}
+	return multiErr(errs)
+}
+
+// withHooks wraps the command cmd so the pre hooks run before it and the post hooks after.  cmd
+// does not run if a pre hook fails.  Post hooks always run, even after an interrupt.
+func (g *gobuildMain) withHooks(cmd string, f func(context.Context, []string) error) func(context.Context, []string) error {
+	return func(ctx context.Context, dirs []string) error {
+		preName, postName := hookName("pre", cmd), hookName("post", cmd)
+		pre, err := g.hooksFor(dirs, preName)
+		if err != nil {
+			return err
+		}
+		post, err := g.hooksFor(dirs, postName)
+		if err != nil {
+			return err
+		}
+		var runErr error
+		preErr := g.runHooks(ctx, preName, pre, true)
+		if preErr == nil {
+			runErr = f(ctx, dirs)
+		}
+		postCtx, cancel := artifactContext(ctx)
+		defer cancel()
+		postErr := g.runHooks(postCtx, postName, post, false)
+		return multiErr([]error{preErr, runErr, postErr})
+	}
+}
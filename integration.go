@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"go/build"
+	"go/build/constraint"
+	"os"
+	"strings"
+)
+
+// integrationDirs filters dirs to those with a test file built only with one of the integration tags
+// from the directory's template
+func integrationDirs(dirs []string, cache *templateCache) ([]string, error) {
+	ret := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		tmpl, err := cache.loadInDir(dir)
+		if err != nil {
+			return nil, wraperr(err, "unable to load template for %s", dir)
+		}
+		testFiles, err := filesWithGlobInDir([]string{dir}, "*_test.go")
+		if err != nil {
+			return nil, wraperr(err, "cannot list test files in %s", dir)
+		}
+		for _, filename := range testFiles {
+			tagged, err := hasBuildTag(filename, tmpl.Integration.Tags)
+			if err != nil {
+				return nil, err
+			}
+			if tagged {
+				ret = append(ret, dir)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// hasBuildTag is true if filename has a build constraint, before its package clause, that is only
+// satisfied when one of tags is set.  Other tags match the default build context.
+func hasBuildTag(filename string, tags []string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, wraperr(err, "cannot open %s", filename)
+	}
+	var goBuild constraint.Expr
+	plusBuild := make([]constraint.Expr, 0, 1)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) && !constraint.IsPlusBuild(line) {
+			continue
+		}
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			return false, multiErr([]error{wraperr(err, "invalid build constraint in %s", filename), f.Close()})
+		}
+		if constraint.IsGoBuild(line) {
+			goBuild = expr
+		} else {
+			plusBuild = append(plusBuild, expr)
+		}
+	}
+	if err := multiErr([]error{s.Err(), f.Close()}); err != nil {
+		return false, wraperr(err, "cannot read %s", filename)
+	}
+	// //go:build replaces // +build lines, which must all be satisfied
+	expr := goBuild
+	for i := 0; expr == nil && i < len(plusBuild); i++ {
+		expr = plusBuild[i]
+		for _, other := range plusBuild[i+1:] {
+			expr = &constraint.AndExpr{X: expr, Y: other}
+		}
+	}
+	if expr == nil {
+		return false, nil
+	}
+	withTags := expr.Eval(func(tag string) bool { return contains(tags, tag) || defaultBuildTag(tag) })
+	withoutTags := expr.Eval(func(tag string) bool { return !contains(tags, tag) && defaultBuildTag(tag) })
+	return withTags && !withoutTags, nil
+}
+
+// defaultBuildTag is true for the tags go build sets by default on this machine
+func defaultBuildTag(tag string) bool {
+	def := build.Default
+	switch tag {
+	case def.GOOS, def.GOARCH, def.Compiler:
+		return true
+	case "cgo":
+		return def.CgoEnabled
+	case "unix":
+		return def.GOOS != "windows" && def.GOOS != "plan9" && def.GOOS != "js" && def.GOOS != "wasip1"
+	}
+	return contains(def.ReleaseTags, tag) || contains(def.BuildTags, tag) || contains(def.ToolTags, tag)
+}
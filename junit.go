@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	testPass = "pass"
+	testFail = "fail"
+	testSkip = "skip"
+)
+
+// testCase is the result of one test or subtest
+type testCase struct {
+	name     string
+	status   string
+	duration time.Duration
+	output   []string
+	// started is when the latest run of the test began, to time tests that never finished
+	started time.Time
+	// flaky is set for tests that failed, then passed on a retry
+	flaky bool
+	// quarantined is set for tests whose failures are ignored, for quarantineReason
+	quarantined      bool
+	quarantineReason string
+}
+
+// packageTests is every test result for one package
+type packageTests struct {
+	name     string
+	failed   bool
+	duration time.Duration
+	tests    []*testCase
+	// output is printed by the package outside of any test, like build failures or panics
+	output []string
+}
+
+func (p *packageTests) testNamed(name string) *testCase {
+	for _, t := range p.tests {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &testCase{name: name}
+	p.tests = append(p.tests, t)
+	return t
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	// FlakyFailure follows the maven surefire convention for tests that passed on a retry
+	FlakyFailure *junitMessage `xml:"flakyFailure,omitempty"`
+	SystemOut    string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// quarantineOf returns the quarantine that applies to t, including quarantines of its top level
+// test, and its reason
+func quarantineOf(pkg *packageTests, t *testCase) (bool, string) {
+	if t.quarantined {
+		return true, t.quarantineReason
+	}
+	top := topLevelTest(t.name)
+	for _, other := range pkg.tests {
+		if other.name == top {
+			return other.quarantined, other.quarantineReason
+		}
+	}
+	return false, ""
+}
+
+// packageFailureName is the test case name used for a package that failed outside of any test
+const packageFailureName = "(package)"
+
+func junitSuite(pkg *packageTests) junitTestSuite {
+	suite := junitTestSuite{
+		Name:  pkg.name,
+		Time:  junitSeconds(pkg.duration),
+		Cases: make([]junitTestCase, 0, len(pkg.tests)+1),
+	}
+	anyFailed := false
+	for _, t := range pkg.tests {
+		if t.quarantined && t.status != testPass {
+			// Only the top level test is quarantined: its failed subtests are reported with it
+			anyFailed = true
+		}
+	}
+	for _, t := range pkg.tests {
+		c := junitTestCase{
+			Classname: pkg.name,
+			Name:      t.name,
+			Time:      junitSeconds(t.duration),
+		}
+		output := strings.Join(t.output, "\n")
+		if quarantined, reason := quarantineOf(pkg, t); quarantined && t.status != testPass {
+			suite.Skipped++
+			c.Skipped = &junitMessage{Message: "quarantined"}
+			if reason != "" {
+				c.Skipped.Message += ": " + reason
+			}
+			c.SystemOut = output
+			suite.Cases = append(suite.Cases, c)
+			continue
+		}
+		switch t.status {
+		case testPass:
+			if t.flaky {
+				c.FlakyFailure = &junitMessage{Message: "Flaky", Contents: output}
+			}
+		case testFail:
+			anyFailed = true
+			suite.Failures++
+			c.Failure = &junitMessage{Message: "Failed", Contents: output}
+		case testSkip:
+			suite.Skipped++
+			c.Skipped = &junitMessage{Message: strings.TrimSpace(output)}
+		default:
+			// A test that never finished, usually because the package panicked or timed out
+			anyFailed = true
+			suite.Failures++
+			c.Failure = &junitMessage{Message: "Did not finish", Contents: output}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if pkg.failed && !anyFailed {
+		suite.Failures++
+		suite.Cases = append(suite.Cases, junitTestCase{
+			Classname: pkg.name,
+			Name:      packageFailureName,
+			Time:      junitSeconds(pkg.duration),
+			Failure:   &junitMessage{Message: "Failed", Contents: strings.Join(pkg.output, "\n")},
+		})
+	}
+	suite.Tests = len(suite.Cases)
+	return suite
+}
+
+// writeJunitXML writes pkgs as a JUnit XML report with one testsuite per package
+func writeJunitXML(w io.Writer, pkgs []*packageTests) error {
+	suites := junitTestSuites{
+		Suites: make([]junitTestSuite, 0, len(pkgs)),
+	}
+	for _, pkg := range pkgs {
+		suites.Suites = append(suites.Suites, junitSuite(pkg))
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return wraperr(err, "cannot write junit XML header")
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(suites); err != nil {
+		return wraperr(err, "cannot encode junit XML")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"io"
 
@@ -15,6 +22,7 @@ import (
 	"os/exec"
 
 	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
 )
 
 type gobuildMain struct {
@@ -26,9 +34,25 @@ type gobuildMain struct {
 		chunkSize      int
 		forceAbs       bool
 		filenamePrefix string
+		workers        int
+		deadline       time.Duration
+		failFast       bool
+		keepGoing      bool
+		noCache        bool
+		since          string
+		affected       bool
+		watchDelay     time.Duration
+		shard          string
+		timings        string
+		benchBaseline  string
+		coverBaseline  string
+		updateBaseline bool
 	}
 
 	tc                templateCache
+	results           resultCache
+	shard             shard
+	budget            workerBudget
 	storageDir        string
 	testrunStorageDir string
 
@@ -38,6 +62,11 @@ type gobuildMain struct {
 	stderr io.Writer
 
 	onClose []func() error
+
+	interrupted bool
+
+	installMu sync.Mutex
+	installed bool
 }
 
 var mainInstance = gobuildMain{
@@ -53,6 +82,19 @@ func init() {
 	flag.IntVar(&mainInstance.flags.chunkSize, "chunksize", 250, "size to chunk xargs into")
 	flag.StringVar(&mainInstance.flags.filenamePrefix, "filename_prefix", "", "Prefix to append to all generated files")
 	flag.BoolVar(&mainInstance.flags.forceAbs, "abs", false, "will force abs paths for ... dirs")
+	flag.IntVar(&mainInstance.flags.workers, "j", runtime.GOMAXPROCS(0), "number of directories to run in parallel")
+	flag.DurationVar(&mainInstance.flags.deadline, "deadline", 0, "if set, cancel the command after this long")
+	flag.BoolVar(&mainInstance.flags.failFast, "failfast", false, "stop at the first failing phase or directory")
+	flag.BoolVar(&mainInstance.flags.keepGoing, "keepgoing", false, "run every phase and directory even after failures (the default)")
+	flag.BoolVar(&mainInstance.flags.noCache, "nocache", false, "ignore cached passes and run every directory")
+	flag.StringVar(&mainInstance.flags.since, "since", "", "only include directories with files changed since this git ref")
+	flag.BoolVar(&mainInstance.flags.affected, "affected", false, "with -since, also include directories with packages that import a changed package")
+	flag.StringVar(&mainInstance.flags.shard, "shard", "", "zero based index/total of the test directories to run, for splitting tests across CI nodes")
+	flag.StringVar(&mainInstance.flags.timings, "timings", "", "glob of test_timings.json files from earlier runs used to balance -shard.  Every shard must read the same files.  Without it shards are split round robin")
+	flag.StringVar(&mainInstance.flags.benchBaseline, "bench-baseline", "", "benchmark results file to compare bench against")
+	flag.StringVar(&mainInstance.flags.coverBaseline, "coverage-baseline", "", "coverage file from an earlier test run that package and total coverage must not drop below")
+	flag.BoolVar(&mainInstance.flags.updateBaseline, "update-baseline", false, "update the -bench-baseline and -coverage-baseline files with this run's results instead of failing on regressions")
+	flag.DurationVar(&mainInstance.flags.watchDelay, "watchdelay", time.Millisecond*500, "how often watch polls for changes, and how long files must be unchanged before it reruns")
 }
 
 func main() {
@@ -60,11 +102,68 @@ func main() {
 	mainInstance.args = flag.Args()
 	if err := mainInstance.main(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-		os.Exit(1)
+		os.Exit(mainInstance.exitCode(err))
+	}
+}
+
+// exitCode is the status gobuild exits with when main returns err
+func (g *gobuildMain) exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case g.interrupted:
+		return exitCodeInterrupted
+	default:
+		return 1
 	}
 }
 
+// exitCodeInterrupted is the exit status when a command is stopped by SIGINT or -deadline
+const exitCodeInterrupted = 130
+
+// mainContext returns a context that ends on SIGINT/SIGTERM or when -deadline passes.  A second
+// signal uses the default handler, which kills gobuild immediately.
+func (g *gobuildMain) mainContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if g.flags.deadline > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, g.flags.deadline)
+		cancelParent := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelParent()
+		}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(g.stderr, "Received %s: stopping child processes\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// artifactContext returns ctx, or a short lived replacement if ctx has already ended, so partial
+// results can still be written out after an interrupt
+func artifactContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(context.Background(), time.Second*30)
+}
+
 func (g *gobuildMain) parseFlags() error {
+	if g.flags.failFast && g.flags.keepGoing {
+		return errors.New("-failfast and -keepgoing cannot both be set")
+	}
+	if g.flags.affected && g.flags.since == "" {
+		return errors.New("-affected requires -since")
+	}
 	vlog := ioutil.Discard
 	if g.flags.verbose {
 		vlog = os.Stderr
@@ -80,6 +179,10 @@ func (g *gobuildMain) parseFlags() error {
 	g.verboseLog = log.New(vlog, "[gobuild-verbose]", log.LstdFlags|log.Lshortfile)
 	g.errLog = log.New(os.Stderr, "[gobuild-err]", log.LstdFlags|log.Lshortfile)
 	g.tc.verboseLog = g.verboseLog
+	g.results.dir = filepath.Join(os.TempDir(), "gobuild-cache")
+	g.results.disabled = g.flags.noCache
+	g.results.verboseLog = g.verboseLog
+	g.budget = newWorkerBudget(g.flags.workers)
 
 	var err error
 	g.storageDir, err = g.storageDirectory()
@@ -92,9 +195,24 @@ func (g *gobuildMain) parseFlags() error {
 	}
 	g.verboseLog.Printf("Storing results to %s", g.storageDir)
 
+	if g.shard, err = g.loadShard(); err != nil {
+		return wraperr(err, "cannot load test shard")
+	}
+
 	return nil
 }
 
+func (g *gobuildMain) loadShard() (shard, error) {
+	if g.flags.shard != "" {
+		return parseShard(g.flags.shard)
+	}
+	tmpl, err := g.tc.loadInDir(".")
+	if err != nil {
+		return shard{}, wraperr(err, "cannot load root dir template")
+	}
+	return shardFromEnv(tmpl)
+}
+
 func (g *gobuildMain) getArgs() (string, []string) {
 	if len(g.args) == 0 {
 		return "check", []string{"./..."}
@@ -132,6 +250,10 @@ func (g *gobuildMain) lint(ctx context.Context, dirs []string) error {
 		metaOutput: &myselfOutput{&nopCloseWriter{os.Stderr}},
 		dirsToLint: testDirs,
 		cache:      &g.tc,
+		workers:    g.flags.workers,
+		budget:     g.budget,
+		failFast:   g.flags.failFast,
+		results:    &g.results,
 	}
 	return c.Run(ctx)
 }
@@ -148,6 +270,10 @@ func (g *gobuildMain) build(ctx context.Context, dirs []string) error {
 		cmdStderr:  &myselfOutput{&nopCloseWriter{os.Stderr}},
 		dirs:       buildableDirs,
 		cache:      &g.tc,
+		workers:    g.flags.workers,
+		budget:     g.budget,
+		failFast:   g.flags.failFast,
+		results:    &g.results,
 	}
 	return c.Run(ctx)
 }
@@ -160,21 +286,23 @@ func (g *gobuildMain) dupl(ctx context.Context, dirs []string) error {
 	if err != nil {
 		return wraperr(err, "cannot load root dir template")
 	}
-	htmlOut, err := os.Create(filepath.Join(g.storageDir, g.flags.filenamePrefix+"dupl.html"))
-	if err != nil {
-		return wraperr(err, "cannot create coverage html file")
-	}
 	c := duplCmd{
-		verboseLog: g.verboseLog,
-		dirs:       dirs,
-		consoleOut: os.Stdout,
-		htmlOut:    htmlOut,
-		tmpl:       tmpl,
+		verboseLog:   g.verboseLog,
+		dirs:         dirs,
+		consoleOut:   os.Stdout,
+		htmlFilename: filepath.Join(g.storageDir, g.flags.filenamePrefix+"dupl.html"),
+		tmpl:         tmpl,
+		results:      &g.results,
 	}
-	return multiErr([]error{c.Run(ctx), htmlOut.Close()})
+	return c.Run(ctx)
 }
 
 func (g *gobuildMain) install(ctx context.Context, dirs []string) error {
+	g.installMu.Lock()
+	defer g.installMu.Unlock()
+	if g.installed {
+		return nil
+	}
 	tmpl, err := g.tc.loadInDir(".")
 	if err != nil {
 		return wraperr(err, "cannot load root dir template")
@@ -187,7 +315,11 @@ func (g *gobuildMain) install(ctx context.Context, dirs []string) error {
 		stderrOutput:   os.Stderr,
 		tmpl:           tmpl,
 	}
-	return c.Run(ctx)
+	if err := c.Run(ctx); err != nil {
+		return err
+	}
+	g.installed = true
+	return nil
 }
 
 func (g *gobuildMain) testReportDirectory() (string, error) {
@@ -223,91 +355,328 @@ func (g *gobuildMain) test(ctx context.Context, dirs []string) error {
 	if err != nil {
 		return wraperr(err, "cannot find *.go files in dirs")
 	}
+	prefix := g.flags.filenamePrefix
+	if g.shard.enabled() {
+		// Without a timings source every shard can read, shards could load different history and
+		// disagree on the split, so fall back to round robin
+		var timings testTimings
+		if g.flags.timings != "" {
+			if timings, err = loadTestTimings(g.flags.timings); err != nil {
+				return wraperr(err, "cannot load test timings")
+			}
+			fmt.Printf("Shard %s balanced with %d timings, hash %s\n", g.shard, len(timings), timings.hash())
+		} else {
+			fmt.Printf("Shard %s split round robin: no -timings\n", g.shard)
+		}
+		testDirs = g.shard.dirs(testDirs, timings)
+		prefix += g.shard.prefix()
+		g.verboseLog.Printf("Shard %s running %d test directories", g.shard, len(testDirs))
+	}
+	return g.runTests(ctx, testDirs, prefix, false)
+}
 
-	fullCoverageFilename := filepath.Join(g.storageDir, g.flags.filenamePrefix+"full_coverage_output.cover.txt")
+func (g *gobuildMain) integration(ctx context.Context, dirs []string) error {
+	testDirs, err := dirsWithFileGob(dirs, "*_test.go")
+	if err != nil {
+		return wraperr(err, "cannot find *_test.go files in dirs")
+	}
+	testDirs, err = integrationDirs(testDirs, &g.tc)
+	if err != nil {
+		return err
+	}
+	g.verboseLog.Printf("Running integration tests in %d directories", len(testDirs))
+	return g.runTests(ctx, testDirs, g.flags.filenamePrefix+"integration_", true)
+}
+
+// runTests tests testDirs, writing coverage, test output and reports to artifacts starting with
+// prefix.  Integration runs use the [integration] tags, env and timeout and do not record timings.
+func (g *gobuildMain) runTests(ctx context.Context, testDirs []string, prefix string, integration bool) error {
+	coverSuffix := ".cover.txt"
+	var timings testTimings
+	if integration {
+		coverSuffix = ".integration.cover.txt"
+	} else {
+		timings = make(testTimings, len(testDirs))
+	}
+	tmpl, err := g.tc.loadInDir(".")
+	if err != nil {
+		return wraperr(err, "cannot load root dir template")
+	}
+	// Read thresholds before testing, so a bad value does not waste a test run
+	coverageTolerance, err := tmpl.varNumber("coverageTolerance")
+	if err != nil {
+		return err
+	}
+	patchCoverage, err := tmpl.varNumber("patchCoverage")
+	if err != nil {
+		return err
+	}
+	fullCoverageFilename := filepath.Join(g.storageDir, prefix+"full_coverage_output.cover.txt")
 	fullOut, err := os.Create(fullCoverageFilename)
 	if err != nil {
 		return wraperr(err, "cannot create full coverage profile file")
 	}
-	fullTestOutputFilename := filepath.Join(g.storageDir, g.flags.filenamePrefix+"full_test_output.txt")
+	fullTestOutputFilename := filepath.Join(g.storageDir, prefix+"full_test_output.txt")
 	fullTestStdout, err := os.Create(fullTestOutputFilename)
 	if err != nil {
 		return wraperr(err, "cannot create full test output file")
 	}
+	testEventsFilename := filepath.Join(g.storageDir, prefix+"test_events.jsonl")
+	testEvents, err := os.Create(testEventsFilename)
+	if err != nil {
+		return wraperr(err, "cannot create test events file")
+	}
+	slowTestsFilename := filepath.Join(g.storageDir, prefix+"slow_tests.txt")
+	slowTestsOut, err := os.Create(slowTestsFilename)
+	if err != nil {
+		return wraperr(err, "cannot create slow tests file")
+	}
+	racesFilename := filepath.Join(g.storageDir, prefix+"races.json")
+	racesOut, err := os.Create(racesFilename)
+	if err != nil {
+		return wraperr(err, "cannot create data races file")
+	}
 	c := goCoverageCheck{
 		dirs:                testDirs,
 		cache:               &g.tc,
-		coverProfileOutTo:   inDirStreamer(g.storageDir, ".cover.txt"),
+		workers:             g.flags.workers,
+		budget:              g.budget,
+		failFast:            g.flags.failFast,
+		coverProfileOutTo:   inDirStreamer(g.storageDir, coverSuffix),
 		testStdoutOutputTo:  &myselfOutput{&nopCloseWriter{os.Stdout}},
 		testStderrOutputTo:  &myselfOutput{&nopCloseWriter{os.Stderr}},
+		summaryOut:          os.Stdout,
 		verboseLog:          g.verboseLog,
 		errLog:              g.errLog,
 		fullCoverageOutput:  fullOut,
 		aggregateTestStdout: fullTestStdout,
+		testEventsOutput:    testEvents,
+		slowTestsOutput:     slowTestsOut,
+		racesOutput:         racesOut,
+		crashDumpPrefix:     filepath.Join(g.storageDir, prefix+"crash_"),
+		timings:             timings,
+		integration:         integration,
+		requiredCoverage:    tmpl.varFloat("testCoverage"),
 	}
 	e1 := c.Run(ctx)
+	complete := ctx.Err() == nil
+	ctx, cancel := artifactContext(ctx)
+	defer cancel()
 	e2 := fullOut.Close()
 	var e3 error
 	if e2 == nil {
-		htmlFilename := filepath.Join(g.storageDir, g.flags.filenamePrefix+"full_coverage_output.cover.html")
-		e3 = g.genCoverageHTML(ctx, fullCoverageFilename, htmlFilename)
+		htmlFilename := filepath.Join(g.storageDir, prefix+"full_coverage_output.cover.html")
+		coberturaFilename := filepath.Join(g.storageDir, prefix+"full_coverage_output.cobertura.xml")
+		e3 = multiErr([]error{g.genCoverageHTML(ctx, fullCoverageFilename, htmlFilename), g.genCobertura(ctx, fullCoverageFilename, coberturaFilename)})
 	}
 	e4 := fullTestStdout.Close()
-	var e5 error
-	if e4 == nil {
-		e5 = g.genJunitXML(ctx, fullTestOutputFilename)
+	e5 := testEvents.Close()
+	var e6 error
+	if e5 == nil {
+		e6 = g.genJunitXML(ctx, testEventsFilename, prefix)
+	}
+	var e7 error
+	if timings != nil {
+		e7 = timings.write(filepath.Join(g.storageDir, prefix+"test_timings.json"))
+	}
+	e8 := slowTestsOut.Close()
+	e9 := racesOut.Close()
+	var e10 error
+	if g.flags.coverBaseline != "" && !integration && complete && e2 == nil {
+		// -since and -shard test a subset of the packages, whose total is not comparable
+		allPackages := g.flags.since == "" && !g.shard.enabled()
+		e10 = compareCoverageBaseline(fullCoverageFilename, g.flags.coverBaseline, coverageTolerance, allPackages, g.flags.updateBaseline, os.Stdout)
+	}
+	var e11 error
+	if g.flags.since != "" && !integration && complete && e2 == nil {
+		e11 = g.patchCoverage(ctx, fullCoverageFilename, testDirs, prefix, patchCoverage)
+	}
+	return multiErr([]error{e1, e2, e3, e4, e5, e6, e7, e8, e9, e10, e11})
+}
+
+// patchCoverage prints and saves the coverage of lines changed in testDirs since the -since git ref
+func (g *gobuildMain) patchCoverage(ctx context.Context, coverageFilename string, testDirs []string, prefix string, required float64) error {
+	out, err := os.Create(filepath.Join(g.storageDir, prefix+"patch_coverage.txt"))
+	if err != nil {
+		return wraperr(err, "cannot create patch coverage file")
+	}
+	err = checkPatchCoverage(ctx, coverageFilename, g.flags.since, testDirs, g.flags.chunkSize, required, io.MultiWriter(os.Stdout, out))
+	return multiErr([]error{err, out.Close()})
+}
+
+func (g *gobuildMain) bench(ctx context.Context, dirs []string) error {
+	benchDirs, err := dirsWithFileGob(dirs, "*_test.go")
+	if err != nil {
+		return wraperr(err, "cannot find *_test.go files in dirs")
+	}
+	resultsOut, err := os.Create(filepath.Join(g.storageDir, g.flags.filenamePrefix+"bench_results.json"))
+	if err != nil {
+		return wraperr(err, "cannot create benchmark results file")
+	}
+	c := benchCmd{
+		dirs:             benchDirs,
+		cache:            &g.tc,
+		baselineFilename: g.flags.benchBaseline,
+		updateBaseline:   g.flags.updateBaseline,
+		verboseLog:       g.verboseLog,
+		errLog:           g.errLog,
+		cmdStdout:        &myselfOutput{&nopCloseWriter{os.Stdout}},
+		cmdStderr:        &myselfOutput{&nopCloseWriter{os.Stderr}},
+		resultsOut:       resultsOut,
+		summaryOut:       os.Stdout,
+	}
+	return multiErr([]error{c.Run(ctx), resultsOut.Close()})
+}
+
+func (g *gobuildMain) fuzz(ctx context.Context, dirs []string) error {
+	fuzzDirs, err := dirsWithFileGob(dirs, "*_test.go")
+	if err != nil {
+		return wraperr(err, "cannot find *_test.go files in dirs")
+	}
+	tmpl, err := g.tc.loadInDir(".")
+	if err != nil {
+		return wraperr(err, "cannot load root dir template")
+	}
+	workers := 1
+	if tmpl.FuzzInParallel() {
+		workers = g.flags.workers
+	}
+	c := fuzzCmd{
+		dirs:        fuzzDirs,
+		cache:       &g.tc,
+		workers:     workers,
+		budget:      g.budget,
+		failFast:    g.flags.failFast,
+		crashersDir: filepath.Join(g.storageDir, g.flags.filenamePrefix+"fuzz"),
+		verboseLog:  g.verboseLog,
+		errLog:      g.errLog,
+		cmdStdout:   &myselfOutput{&nopCloseWriter{os.Stdout}},
+		cmdStderr:   &myselfOutput{&nopCloseWriter{os.Stderr}},
 	}
-	return multiErr([]error{e1, e2, e3, e4, e5})
+	return c.Run(ctx)
 }
 
-func (g *gobuildMain) genJunitXML(ctx context.Context, fullTestOutputFilename string) error {
+func (g *gobuildMain) genJunitXML(ctx context.Context, testEventsFilename string, prefix string) error {
 	junitXMLOutputFileDir := filepath.Join(g.testrunStorageDir, "gotest")
 	if _, err := os.Stat(junitXMLOutputFileDir); err != nil {
 		if err := os.Mkdir(junitXMLOutputFileDir, 0777); err != nil {
 			return wraperr(err, "cannot make temp dir %s", junitXMLOutputFileDir)
 		}
 	}
-	xmlOutFilename := filepath.Join(junitXMLOutputFileDir, g.flags.filenamePrefix+"junit-gotest.xml")
+	xmlOutFilename := filepath.Join(junitXMLOutputFileDir, prefix+"junit-gotest.xml")
 	xmlOutFile, err := os.Create(xmlOutFilename)
 	if err != nil {
 		return wraperr(err, "cannot open xml run output file")
 	}
-	fullTestOutput, err := os.Open(fullTestOutputFilename)
+	testEvents, err := os.Open(testEventsFilename)
 	if err != nil {
-		return wraperr(err, "cannot open test file for output")
+		return wraperr(err, "cannot open test events file")
 	}
-	return multiErr([]error{g.genJunitXMLFromBuffers(ctx, fullTestOutput, xmlOutFile), xmlOutFile.Close(), fullTestOutput.Close()})
+	return multiErr([]error{g.genJunitXMLFromBuffers(ctx, testEvents, xmlOutFile), xmlOutFile.Close(), testEvents.Close()})
 }
 
 func (g *gobuildMain) genJunitXMLFromBuffers(ctx context.Context, testInput io.Reader, testOutput io.Writer) error {
-	cmd := exec.Command("go-junit-report")
-	cmd.Stdin = testInput
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = testOutput
-	g.verboseLog.Printf("Generating junit XML with %v", cmd)
-	if err := cmd.Run(); err != nil {
+	g.verboseLog.Printf("Generating junit XML")
+	events, err := readTestEvents(testInput)
+	if err != nil {
+		return wraperr(err, "cannot parse test events")
+	}
+	if err := writeJunitXML(testOutput, packagesFromEvents(events)); err != nil {
 		return wraperr(err, "test junit XML generation failed")
 	}
 	return nil
 }
 
+// genCoverageHTML renders the cover profile coverFilename as the HTML report htmlFilename
 func (g *gobuildMain) genCoverageHTML(ctx context.Context, coverFilename string, htmlFilename string) error {
 	cmd := exec.Command("go", "tool", "cover", "-o", htmlFilename, "-html", coverFilename)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	g.verboseLog.Printf("Generating coverage html %s => %s with %v", coverFilename, htmlFilename, cmd)
-	if err := cmd.Run(); err != nil {
+	if err := runCmd(ctx, cmd); err != nil {
 		return wraperr(err, "coverage HTML generation failed")
 	}
 	return nil
 }
 
+// genCobertura converts the cover profile coverFilename to the Cobertura XML report xmlFilename, with
+// file names relative to the current directory
+func (g *gobuildMain) genCobertura(ctx context.Context, coverFilename string, xmlFilename string) error {
+	g.verboseLog.Printf("Generating cobertura XML %s => %s", coverFilename, xmlFilename)
+	profiles, err := cover.ParseProfiles(coverFilename)
+	if err != nil {
+		return wraperr(err, "cannot parse coverage profile file %s", coverFilename)
+	}
+	fileDirs, err := profileDirs(ctx, profiles, g.flags.chunkSize)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(xmlFilename)
+	if err != nil {
+		return wraperr(err, "cannot create cobertura XML file")
+	}
+	return multiErr([]error{writeCobertura(out, newCobertura(profiles, fileDirs, realPath("."), time.Now())), out.Close()})
+}
+
+func (g *gobuildMain) checkPhases() map[string]func(context.Context, []string) error {
+	return map[string]func(context.Context, []string) error{
+		"build": g.withHooks("build", g.build),
+		"lint":  g.withHooks("lint", g.lint),
+		"dupl":  g.withHooks("dupl", g.dupl),
+		"test":  g.withHooks("test", g.test),
+		"bench": g.withHooks("bench", g.bench),
+		"fuzz":  g.withHooks("fuzz", g.fuzz),
+
+		"integration": g.withHooks("integration", g.integration),
+	}
+}
+
 func (g *gobuildMain) check(ctx context.Context, dirs []string) error {
-	buildErr := g.build(ctx, dirs)
-	lintErr := g.lint(ctx, dirs)
-	duplErr := g.dupl(ctx, dirs)
-	testErr := g.test(ctx, dirs)
-	return multiErr([]error{buildErr, lintErr, duplErr, testErr})
+	tmpl, err := g.tc.loadInDir(".")
+	if err != nil {
+		return wraperr(err, "cannot load root dir template")
+	}
+	phases := g.checkPhases()
+	for _, phase := range tmpl.Check.Phases {
+		if _, exists := phases[phase]; !exists {
+			return fmt.Errorf("unknown check phase %s", phase)
+		}
+	}
+	dependents := make([]string, 0, len(tmpl.Check.Depends))
+	for phase := range tmpl.Check.Depends {
+		dependents = append(dependents, phase)
+	}
+	sort.Strings(dependents)
+	for _, phase := range dependents {
+		for _, name := range append([]string{phase}, tmpl.Check.Depends[phase]...) {
+			if _, exists := phases[name]; !exists {
+				return fmt.Errorf("unknown check phase %s in [check.depends]", name)
+			}
+		}
+	}
+	pg := phaseGraph{
+		phases:  tmpl.Check.Phases,
+		depends: tmpl.Check.Depends,
+		// Other phases running at the same time would skew benchmark timings
+		exclusive: map[string]bool{"bench": true},
+		run: func(ctx context.Context, phase string) error {
+			return phases[phase](ctx, dirs)
+		},
+		failFast:   g.flags.failFast,
+		verboseLog: g.verboseLog,
+	}
+	results, err := pg.Run(ctx)
+	if err != nil {
+		return wraperr(err, "cannot run check phases")
+	}
+	errs := make([]error, 0, len(results)+1)
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, wraperr(r.err, "check phase %s %s", r.name, r.status()))
+		}
+	}
+	errs = append(errs, writePhaseSummary(g.stderr, results))
+	return multiErr(errs)
 }
 
 func (g *gobuildMain) list(ctx context.Context, dirs []string) error {
@@ -316,6 +685,32 @@ func (g *gobuildMain) list(ctx context.Context, dirs []string) error {
 	return nil
 }
 
+// watch reruns a command on changed directories.  args is an optional command name, which
+// defaults to check, followed by the paths to watch.
+func (g *gobuildMain) watch(ctx context.Context, cmdMap map[string]func(context.Context, []string) error, args []string, pe *pathExpansion) error {
+	cmd := "check"
+	if len(args) > 0 {
+		if _, exists := cmdMap[args[0]]; exists {
+			cmd = args[0]
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"./..."}
+	}
+	w := watchCmd{
+		cmdName:    cmd,
+		run:        cmdMap[cmd],
+		paths:      args,
+		pe:         pe,
+		cache:      &g.tc,
+		delay:      g.flags.watchDelay,
+		out:        os.Stdout,
+		verboseLog: g.verboseLog,
+	}
+	return w.Run(ctx)
+}
+
 func (g *gobuildMain) Close() error {
 	errs := make([]error, 0, len(g.onClose))
 	for _, f := range g.onClose {
@@ -336,39 +731,50 @@ func (g *gobuildMain) main() error {
 	if err := g.parseFlags(); err != nil {
 		return wraperr(err, "cannot parse flags")
 	}
-	ctx := context.Background()
+	ctx, cancel := g.mainContext()
+	defer cancel()
 
 	pe := pathExpansion{
-		forceAbs: g.flags.forceAbs,
-		log:      g.verboseLog,
-		template: &g.tc,
+		forceAbs:  g.flags.forceAbs,
+		since:     g.flags.since,
+		affected:  g.flags.affected,
+		chunkSize: g.flags.chunkSize,
+		log:       g.verboseLog,
+		template:  &g.tc,
 	}
 
 	cmdMap := map[string]func(context.Context, []string) error{
-		"fix":     g.fix,
-		"lint":    g.lint,
+		"fix":     g.withHooks("fix", g.fix),
 		"list":    g.list,
-		"build":   g.build,
-		"test":    g.test,
-		"dupl":    g.dupl,
-		"install": g.install,
-		"check":   g.check,
+		"install": g.withHooks("install", g.install),
+		"check":   g.withHooks("check", g.check),
+	}
+	for name, f := range g.checkPhases() {
+		cmdMap[name] = f
 	}
 
 	cmd, args := g.getArgs()
+	if cmd == "watch" {
+		return g.watch(ctx, cmdMap, args, &pe)
+	}
 	f, exists := cmdMap[cmd]
 	if !exists {
 		fmt.Fprintf(g.stderr, "Unknown command %s\nValid commands:\n", cmd)
 		for k := range cmdMap {
 			fmt.Fprintf(g.stderr, "  %s\n", k)
 		}
+		fmt.Fprintf(g.stderr, "  watch\n")
 		return fmt.Errorf("unknown command %s", cmd)
 	}
-	dirs, err := pe.expandPaths(args)
+	dirs, err := pe.expandPaths(ctx, args)
 	if err != nil {
 		return wraperr(err, "cannot expand paths %s", strings.Join(args, ","))
 	}
 	if err := f(ctx, dirs); err != nil {
+		if ctx.Err() != nil {
+			g.interrupted = true
+			return wraperr(err, "Interrupted command %s", cmd)
+		}
 		return wraperr(err, "Failure in command %s", cmd)
 	}
 	return nil
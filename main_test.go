@@ -1,9 +1,1213 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/cep21/gobuild/internal/github.com/BurntSushi/toml"
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
 )
 
 func TestBob(t *testing.T) {
 
 }
+
+func TestRunOrdered(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 100} {
+		finished := make([]int, 0, 10)
+		ran := make([]bool, 10)
+		runOrdered(workers, 10, false, func(i int) error {
+			ran[i] = true
+			return nil
+		}, func(i int) {
+			if !ran[i] {
+				t.Errorf("finish called before work for %d", i)
+			}
+			finished = append(finished, i)
+		})
+		for i, f := range finished {
+			if i != f {
+				t.Fatalf("workers=%d: finish out of order: %v", workers, finished)
+			}
+		}
+		if len(finished) != 10 {
+			t.Errorf("workers=%d: expected 10 finishes, got %d", workers, len(finished))
+		}
+	}
+}
+
+func TestRunOrderedFailFast(t *testing.T) {
+	for _, failFast := range []bool{true, false} {
+		ran := make([]bool, 10)
+		finished := make([]int, 0, 10)
+		runOrdered(1, 10, failFast, func(i int) error {
+			ran[i] = true
+			if i == 2 {
+				return errors.New("failed")
+			}
+			return nil
+		}, func(i int) {
+			finished = append(finished, i)
+		})
+		expected := 10
+		if failFast {
+			// Indexes that had not started when 2 failed are skipped
+			expected = 3
+		}
+		for i := range ran {
+			if ran[i] != (i < expected) {
+				t.Errorf("failFast=%t: unexpected ran=%t for %d", failFast, ran[i], i)
+			}
+		}
+		if len(finished) != expected {
+			t.Errorf("failFast=%t: expected %d finishes, got %v", failFast, expected, finished)
+		}
+	}
+}
+
+func TestWorkerBudget(t *testing.T) {
+	budget := newWorkerBudget(2)
+	var mu sync.Mutex
+	running, most := 0, 0
+	work := budget.limit(func(i int) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	wg := sync.WaitGroup{}
+	for caller := 0; caller < 3; caller++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runOrdered(4, 8, false, work, func(i int) {})
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("expected at most 2 workers across callers, got %d", most)
+	}
+}
+
+func TestPhaseGraph(t *testing.T) {
+	var mu sync.Mutex
+	ran := map[string]bool{}
+	pg := phaseGraph{
+		phases:  []string{"build", "lint", "test", "report"},
+		depends: map[string][]string{"test": {"build"}, "report": {"test", "missing"}},
+		run: func(ctx context.Context, phase string) error {
+			mu.Lock()
+			ran[phase] = true
+			mu.Unlock()
+			if phase == "test" {
+				return errors.New("test failed")
+			}
+			return nil
+		},
+		verboseLog: log.New(ioutil.Discard, "", 0),
+	}
+	results, err := pg.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]string, 0, len(results))
+	for _, r := range results {
+		statuses = append(statuses, r.name+"="+r.status())
+	}
+	if strings.Join(statuses, ",") != "build=pass,lint=pass,test=fail,report=skipped" {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+	if ran["report"] {
+		t.Error("report should be skipped when test fails")
+	}
+	if results[2].gatedBy != results[0] {
+		t.Error("test should be gated by build")
+	}
+
+	pg.depends = map[string][]string{"build": {"test"}, "test": {"build"}}
+	if _, err := pg.Run(context.Background()); err == nil {
+		t.Error("expected a cycle error")
+	}
+
+	running := 0
+	overlapped := false
+	pg = phaseGraph{
+		phases:    []string{"build", "lint", "bench"},
+		exclusive: map[string]bool{"bench": true},
+		failFast:  true,
+		run: func(ctx context.Context, phase string) error {
+			mu.Lock()
+			running++
+			overlapped = overlapped || (running > 1 && phase == "bench")
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+			switch phase {
+			case "build":
+				<-ctx.Done()
+				return ctx.Err()
+			case "lint":
+				time.Sleep(time.Millisecond * 10)
+				return errors.New("lint failed")
+			}
+			time.Sleep(time.Millisecond * 10)
+			return nil
+		},
+		verboseLog: log.New(ioutil.Discard, "", 0),
+	}
+	results, err = pg.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].status() != "cancelled" || results[1].status() != "fail" {
+		t.Errorf("expected build cancelled by the lint failure: %s %s", results[0].status(), results[1].status())
+	}
+	if overlapped {
+		t.Error("bench should not run alongside other phases")
+	}
+	if path := criticalPath(results); len(path) == 0 || path[len(path)-1].name == "build" {
+		t.Errorf("a cancelled phase should not be on the critical path: %v", path)
+	}
+}
+
+func TestRunCmdCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are unix only")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 60 & echo $!; wait")
+	cmd.Stdout = &stdout
+	start := time.Now()
+	err := runCmd(ctx, cmd)
+	// The background sleep holds stdout open, so Wait only returns this soon if it was killed too
+	if took := time.Since(start); took > time.Second*10 {
+		t.Errorf("runCmd took %s to return after cancel", took)
+	}
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	pid := strings.TrimSpace(stdout.String())
+	if pid == "" {
+		t.Fatal("expected the child pid")
+	}
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+		// A killed child may stay a zombie until it is reaped, which is gone as far as we care
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %s is still running", pid)
+		}
+	}
+}
+
+func TestMainDeadline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook uses sleep")
+	}
+	dir, err := ioutil.TempDir("", "gobuild-deadline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := multiErr([]error{os.Chdir(wd), os.Unsetenv("GOBUILD_TEST_ARTIFACTS"), os.RemoveAll(dir)}); err != nil {
+			t.Error(err)
+		}
+	}()
+	config := "[vars]\n  artifactsEnv = \"GOBUILD_TEST_ARTIFACTS\"\n  testReportEnv = \"GOBUILD_TEST_ARTIFACTS\"\n" +
+		"[hooks]\n  preFix = [[\"sleep\", \"60\"]]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "gobuild.toml"), []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := multiErr([]error{os.Mkdir(filepath.Join(dir, ".git"), 0777), os.Chdir(dir), os.Setenv("GOBUILD_TEST_ARTIFACTS", dir)}); err != nil {
+		t.Fatal(err)
+	}
+	g := gobuildMain{
+		tc:     templateCache{cache: make(map[string]*buildTemplate)},
+		args:   []string{"fix", "."},
+		stderr: ioutil.Discard,
+	}
+	g.flags.deadline = time.Millisecond * 200
+	start := time.Now()
+	err = g.main()
+	if took := time.Since(start); took > time.Second*10 {
+		t.Errorf("main took %s to return after the deadline", took)
+	}
+	if err == nil || !g.interrupted || g.exitCode(err) != exitCodeInterrupted {
+		t.Errorf("expected an interrupted exit, got interrupted=%t err=%v", g.interrupted, err)
+	}
+}
+
+func TestCheckUnknownPhase(t *testing.T) {
+	wd, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &buildTemplate{}
+	tmpl.MergeFrom(&defaultLoadedTemplate)
+	tmpl.Check.Phases = []string{"build", "tset"}
+	discard := log.New(ioutil.Discard, "", 0)
+	g := gobuildMain{
+		tc:         templateCache{cache: map[string]*buildTemplate{wd: tmpl}, verboseLog: discard},
+		verboseLog: discard,
+	}
+	if err := g.check(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "unknown check phase tset") {
+		t.Errorf("expected an unknown check phase error, got %v", err)
+	}
+	tmpl.Check.Phases = []string{"build", "test"}
+	tmpl.Check.Depends = map[string][]string{"test": {"biuld"}}
+	if err := g.check(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "unknown check phase biuld in [check.depends]") {
+		t.Errorf("expected an unknown depends phase error, got %v", err)
+	}
+	tmpl.Check.Depends = map[string][]string{"tset": {"build"}}
+	if err := g.check(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "unknown check phase tset in [check.depends]") {
+		t.Errorf("expected an unknown depends phase error, got %v", err)
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	start := time.Now()
+	build := &phaseResult{name: "build", start: start, end: start.Add(time.Second)}
+	lint := &phaseResult{name: "lint", start: start, end: start.Add(time.Second * 3)}
+	test := &phaseResult{name: "test", start: build.end, end: build.end.Add(time.Second * 5), gatedBy: build}
+	path := criticalPath([]*phaseResult{build, lint, test})
+	if len(path) != 2 || path[0] != build || path[1] != test {
+		t.Errorf("unexpected critical path %v", path)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobuild-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	goFile := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(goFile, []byte("package a\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r := resultCache{dir: filepath.Join(dir, "cache"), verboseLog: log.New(ioutil.Discard, "", 0)}
+	ctx := context.Background()
+	key, cached := r.check(ctx, "build", []string{dir}, &defaultLoadedTemplate, nil)
+	if cached {
+		t.Fatal("empty cache should not hit")
+	}
+	r.record(key, nil)
+	if _, cached := r.check(ctx, "build", []string{dir}, &defaultLoadedTemplate, nil); !cached {
+		t.Error("expected a cached pass")
+	}
+	if _, cached := r.check(ctx, "lint", []string{dir}, &defaultLoadedTemplate, nil); cached {
+		t.Error("a different phase should not hit")
+	}
+	if err := ioutil.WriteFile(goFile, []byte("package a // changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, cached := r.check(ctx, "build", []string{dir}, &defaultLoadedTemplate, nil); cached {
+		t.Error("a changed file should not hit")
+	}
+	r.disabled = true
+	if err := ioutil.WriteFile(goFile, []byte("package a\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, cached := r.check(ctx, "build", []string{dir}, &defaultLoadedTemplate, nil); cached {
+		t.Error("a disabled cache should not hit")
+	}
+}
+
+func TestResultCacheDeps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobuild-cache-deps-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := os.Getenv("GO111MODULE")
+	defer func() {
+		if err := multiErr([]error{os.Chdir(wd), os.Setenv("GO111MODULE", modules), os.RemoveAll(dir)}); err != nil {
+			t.Error(err)
+		}
+	}()
+	files := map[string]string{
+		"go.mod":      "module m\n",
+		"a/a.go":      "package a\n\nimport _ \"m/b\"\n",
+		"b/b.go":      "package b\n\nimport _ \"m/c\"\n",
+		"c/c.go":      "package c\n",
+		"d/d.go":      "package d\n",
+		"t/t.go":      "package t\n",
+		"t/t_test.go": "package t\n\nimport _ \"m/d\"\n",
+	}
+	for name, src := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := multiErr([]error{os.Chdir(dir), os.Setenv("GO111MODULE", "on")}); err != nil {
+		t.Fatal(err)
+	}
+	r := resultCache{dir: filepath.Join(dir, "cache"), verboseLog: log.New(ioutil.Discard, "", 0)}
+	ctx := context.Background()
+	keys := func() []string {
+		ret := make([]string, 0, 2)
+		for _, pkg := range []string{"a", "t"} {
+			key, err := r.key(ctx, "test", []string{pkg}, &defaultLoadedTemplate, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, key)
+		}
+		return ret
+	}
+	before := keys()
+	if err := ioutil.WriteFile(filepath.Join(dir, "c", "c.go"), []byte("package c // changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "d", "d.go"), []byte("package d // changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	after := keys()
+	if before[0] == after[0] {
+		t.Error("a change to a transitive dependency should change the key")
+	}
+	if before[1] == after[1] {
+		t.Error("a change to a test dependency should change the key")
+	}
+	duplKey := func() string {
+		key, err := r.key(ctx, "dupl", []string{"a", "t"}, &defaultLoadedTemplate, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	duplBefore := duplKey()
+	if err := ioutil.WriteFile(filepath.Join(dir, "c", "c.go"), []byte("package c // changed again\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if duplKey() != duplBefore {
+		t.Error("dupl should only hash the listed files")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "a.go"), []byte("package a // changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if duplKey() == duplBefore {
+		t.Error("a change to a listed file should change the dupl key")
+	}
+}
+
+func TestDependentPackages(t *testing.T) {
+	pkgs := []goPackage{
+		{ImportPath: "m/util"},
+		{ImportPath: "m/db", Imports: []string{"m/util"}},
+		{ImportPath: "m/api", Imports: []string{"m/db"}},
+		{ImportPath: "m/fake", TestImports: []string{"m/util"}},
+		{ImportPath: "m/usesfake", Imports: []string{"m/fake"}},
+		{ImportPath: "m/other"},
+	}
+	affected := dependentPackages(pkgs, []string{"m/util"})
+	for _, expected := range []string{"m/util", "m/db", "m/api", "m/fake"} {
+		if _, exists := affected[expected]; !exists {
+			t.Errorf("expected %s to be affected", expected)
+		}
+	}
+	for _, unexpected := range []string{"m/usesfake", "m/other"} {
+		if _, exists := affected[unexpected]; exists {
+			t.Errorf("did not expect %s to be affected", unexpected)
+		}
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	now := time.Now()
+	before := dirSnapshot{
+		"a": {"a.go": {size: 10, modTime: now}, "gone.go": {size: 1, modTime: now}},
+		"b": {"b.go": {size: 10, modTime: now}},
+	}
+	after := dirSnapshot{
+		"a": {"a.go": {size: 10, modTime: now}, "new.go": {size: 1, modTime: now}},
+		"b": {"b.go": {size: 10, modTime: now.Add(time.Second)}},
+	}
+	changed := changedFiles(before, after)
+	expected := []string{filepath.Join("a", "gone.go"), filepath.Join("a", "new.go"), filepath.Join("b", "b.go")}
+	if strings.Join(changed, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, changed)
+	}
+	if len(changedFiles(after, after)) != 0 {
+		t.Error("identical snapshots should have no changes")
+	}
+}
+
+func TestGitChangedDirs(t *testing.T) {
+	ctx := context.Background()
+	if _, err := gitOutput(ctx, "--version"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "TestGitChangedDirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	write := func(name string, contents string) {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := func(args ...string) {
+		if _, err := gitOutput(ctx, append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a/a.go", "package a\n")
+	write("b/b.go", "package b\n")
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+	write("a/a.go", "package a\n\nvar A = 1\n")
+	write("c/c.go", "package c\n")
+	write("é/café.go", "package e\n")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	}()
+	dirs, err := changedDirs(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "c", "é"} {
+		if _, exists := dirs[realPath(filepath.Join(dir, expected))]; !exists {
+			t.Errorf("expected %s in changed dirs %v", expected, dirs)
+		}
+	}
+	if _, exists := dirs[realPath(filepath.Join(dir, "b"))]; exists || len(dirs) != 3 {
+		t.Errorf("unexpected changed dirs %v", dirs)
+	}
+}
+
+const sampleTestEvents = `{"Action":"start","Package":"example.com/a"}
+{"Action":"run","Package":"example.com/a","Test":"TestPass"}
+{"Action":"output","Package":"example.com/a","Test":"TestPass","Output":"=== RUN   TestPass\n"}
+{"Action":"output","Package":"example.com/a","Test":"TestPass","Output":"--- PASS: TestPass (0.50s)\n"}
+{"Action":"pass","Package":"example.com/a","Test":"TestPass","Elapsed":0.5}
+{"Action":"run","Package":"example.com/a","Test":"TestFail"}
+{"Action":"output","Package":"example.com/a","Test":"TestFail","Output":"    a_test.go:10: bad value\n"}
+{"Action":"fail","Package":"example.com/a","Test":"TestFail","Elapsed":0.01}
+{"Action":"run","Package":"example.com/a","Test":"TestSkip"}
+{"Action":"output","Package":"example.com/a","Test":"TestSkip","Output":"    a_test.go:14: not on this platform\n"}
+{"Action":"skip","Package":"example.com/a","Test":"TestSkip"}
+{"Action":"run","Package":"example.com/a","Test":"TestSub"}
+{"Action":"run","Package":"example.com/a","Test":"TestSub/one"}
+{"Action":"pass","Package":"example.com/a","Test":"TestSub/one","Elapsed":0.01}
+{"Action":"pass","Package":"example.com/a","Test":"TestSub","Elapsed":0.02}
+{"Action":"output","Package":"example.com/a","Output":"FAIL\n"}
+{"Action":"fail","Package":"example.com/a","Elapsed":0.6}
+{"Action":"skip","Package":"example.com/notests","Elapsed":0}
+{"ImportPath":"example.com/b [example.com/b.test]","Action":"build-output","Output":"b.go:3:1: syntax error\n"}
+{"Action":"fail","Package":"example.com/b","Elapsed":0}
+`
+
+func TestJunitXML(t *testing.T) {
+	events, err := readTestEvents(strings.NewReader(sampleTestEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := packagesFromEvents(events)
+	if len(pkgs) != 2 || pkgs[0].name != "example.com/a" || pkgs[1].name != "example.com/b" {
+		t.Fatalf("unexpected packages %v", pkgs)
+	}
+	a := junitSuite(pkgs[0])
+	if a.Tests != 5 || a.Failures != 1 || a.Skipped != 1 || a.Time != "0.600" {
+		t.Errorf("unexpected suite %+v", a)
+	}
+	if a.Cases[1].Failure == nil || !strings.Contains(a.Cases[1].Failure.Contents, "bad value") {
+		t.Errorf("expected failure output on TestFail: %+v", a.Cases[1])
+	}
+	if a.Cases[4].Name != "TestSub/one" || a.Cases[4].Time != "0.010" {
+		t.Errorf("unexpected subtest %+v", a.Cases[4])
+	}
+	b := junitSuite(pkgs[1])
+	if b.Failures != 1 || b.Cases[0].Name != packageFailureName || !strings.Contains(b.Cases[0].Failure.Contents, "syntax error") {
+		t.Errorf("expected build failure in %+v", b)
+	}
+	var buf bytes.Buffer
+	if err := writeJunitXML(&buf, pkgs); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<testsuite name="example.com/a" tests="5" failures="1" skipped="1" time="0.600">`) {
+		t.Errorf("unexpected XML %s", buf.String())
+	}
+}
+
+func TestTestEventWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := testEventWriter{out: &out}
+	input := `{"Action":"output","Package":"p","Test":"TestA","Output":"=== RUN   TestA\n"}` + "\nnot json\n" + `{"Action":"pass","Package":"p","Test":"TestA"}`
+	for _, chunk := range []string{input[:10], input[10:50], input[50:]} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.events) != 2 || w.events[1].Action != testPass {
+		t.Errorf("unexpected events %+v", w.events)
+	}
+	if out.String() != "=== RUN   TestA\nnot json\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestShard(t *testing.T) {
+	s, err := parseShard("1/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := s.dirs([]string{"a", "b", "c", "d", "e"}, nil)
+	if strings.Join(dirs, ",") != "b,e" || s.prefix() != "shard1_" {
+		t.Errorf("unexpected shard dirs %v prefix %s", dirs, s.prefix())
+	}
+	for _, bad := range []string{"3/3", "-1/2", "1", "a/b"} {
+		if _, err := parseShard(bad); err == nil {
+			t.Errorf("expected %s to be an invalid shard", bad)
+		}
+	}
+}
+
+func TestTimingsBalance(t *testing.T) {
+	timings := testTimings{"slow": 600, "medium": 300, "quick1": 150, "quick2": 140, "tiny": 2}
+	groups := timings.balance([]string{"medium", "new1", "new2", "new3", "quick1", "quick2", "slow", "tiny"}, 2)
+	if strings.Join(groups[0], ",") != "new1,new3,slow" || strings.Join(groups[1], ",") != "medium,new2,quick1,quick2,tiny" {
+		t.Errorf("unexpected balance %v", groups)
+	}
+	roundRobin := testTimings(nil).balance([]string{"c", "a", "b"}, 2)
+	if strings.Join(roundRobin[0], ",") != "a,c" || strings.Join(roundRobin[1], ",") != "b" {
+		t.Errorf("unexpected round robin %v", roundRobin)
+	}
+	same := testTimings{"tiny": 2, "slow": 600, "medium": 300, "quick2": 140, "quick1": 150}
+	if timings.hash() != same.hash() || timings.hash() == testTimings(nil).hash() {
+		t.Error("expected the timings hash to only depend on the timings")
+	}
+}
+
+func TestQuarantinedTests(t *testing.T) {
+	events := []testEvent{
+		{Action: "run", Test: "TestA"},
+		{Action: "fail", Test: "TestA"},
+		{Action: "run", Test: "TestB"},
+		{Action: "run", Test: "TestB/one"},
+		{Action: "fail", Test: "TestB/one"},
+		{Action: "fail", Test: "TestB"},
+		{Action: "run", Test: "TestC"},
+		{Action: "pass", Test: "TestC"},
+		{Action: "run", Test: "TestD"},
+	}
+	failed := failedTests(events)
+	if strings.Join(failed, ",") != "TestA,TestB,TestB/one,TestD" {
+		t.Fatalf("unexpected failed tests %v", failed)
+	}
+	retry, quarantined := quarantinedTests(failed, map[string]string{"TestB/one": "known issue", "TestD": "hangs"})
+	if strings.Join(retry, ",") != "TestA" || strings.Join(quarantined, ",") != "TestB,TestD" {
+		t.Errorf("unexpected retry %v quarantined %v", retry, quarantined)
+	}
+	if quarantineReason("TestB", failed, map[string]string{"TestB/one": "known issue"}) != "known issue" {
+		t.Error("expected the subtest quarantine reason")
+	}
+	if !needsPackageRetry(events) {
+		t.Error("a test that never finished should rerun the whole package")
+	}
+	if needsPackageRetry(events[:8]) {
+		t.Error("finished failures should only rerun the failed tests")
+	}
+	mainFailed := []testEvent{{Action: "run", Test: "TestA"}, {Action: "pass", Test: "TestA"}, {Action: "fail"}}
+	if !needsPackageRetry(mainFailed) {
+		t.Error("a package failure outside of any test should rerun the whole package")
+	}
+
+	pkg := &packageTests{name: "a", tests: []*testCase{{name: "TestE", status: testFail, quarantined: true}}}
+	suite := junitSuite(pkg)
+	if suite.Failures != 0 || suite.Cases[0].Skipped == nil || suite.Cases[0].Skipped.Message != "quarantined" {
+		t.Errorf("a quarantine without a reason should still skip the test: %+v", suite)
+	}
+
+	runErr := errors.New("exit status 1")
+	g := &goCoverageCheck{}
+	noRetries := &buildTemplate{}
+	if err := g.retryFailures(context.Background(), ".", noRetries, "", &testResult{events: events}, runErr); err != runErr {
+		t.Errorf("a package that was not retried should keep its error, got %v", err)
+	}
+	err := g.retryFailures(context.Background(), ".", noRetries, "", &testResult{events: events[:8]}, runErr)
+	if err == nil || strings.Contains(err.Error(), "still") || !strings.Contains(err.Error(), "tests failing: TestA, TestB") {
+		t.Errorf("unexpected error without retries %v", err)
+	}
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	fast := []float64{100, 101, 102, 103, 104}
+	slow := []float64{110, 111, 112, 113, 114}
+	if p := mannWhitneyU(fast, slow); math.Abs(p-2.0/252) > 1e-9 {
+		t.Errorf("expected exact p of 2/252, got %f", p)
+	}
+	if p := mannWhitneyU(fast, []float64{100.5, 101.5, 102.5, 103.5, 104.5}); p < 0.5 {
+		t.Errorf("interleaved samples should not be significant, got p=%f", p)
+	}
+	if p := mannWhitneyU([]float64{1, 1, 1}, []float64{1, 1, 1}); p != 1 {
+		t.Errorf("identical samples should have p=1, got %f", p)
+	}
+}
+
+func TestParseBenchOutput(t *testing.T) {
+	out := "goos: linux\nBenchmarkA-8   \t 1000\t 1200 ns/op\t 16 B/op\t 1 allocs/op\nBenchmarkA-8 1000 1300 ns/op 16 B/op 1 allocs/op\nBenchmarkB-8 50 12.5 MB/s\nPASS\n"
+	samples := parseBenchOutput([]byte(out))
+	if len(samples["BenchmarkA-8"]["ns/op"]) != 2 || samples["BenchmarkA-8"]["ns/op"][1] != 1300 {
+		t.Errorf("unexpected samples %v", samples)
+	}
+	if samples["BenchmarkB-8"]["MB/s"][0] != 12.5 || !higherIsBetter("MB/s") {
+		t.Errorf("unexpected throughput samples %v", samples)
+	}
+}
+
+func TestDiscoverFuzzTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobuild-fuzz-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	src := `package a
+
+import "testing"
+
+func FuzzB(f *testing.F) {}
+func FuzzA(f *testing.F) {}
+func FuzzNotTarget(t *testing.T) {}
+func TestA(t *testing.T) {}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "a_test.go"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := discoverFuzzTargets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(targets, ",") != "FuzzA,FuzzB" {
+		t.Errorf("unexpected fuzz targets %v", targets)
+	}
+}
+
+func TestSlowReport(t *testing.T) {
+	s := slowReport{}
+	s.add([]*packageTests{
+		{name: "a", duration: 3 * time.Second, tests: []*testCase{
+			{name: "TestFast", duration: time.Millisecond},
+			{name: "TestSlow", duration: 2 * time.Second},
+			{name: "TestSlow/sub", duration: 2 * time.Second},
+		}},
+		{name: "b", duration: time.Second, tests: []*testCase{
+			{name: "TestMedium", duration: time.Second},
+		}},
+	})
+	tests := slowest(s.tests, 2)
+	if len(tests) != 2 || tests[0].name != "a.TestSlow" || tests[1].name != "b.TestMedium" {
+		t.Errorf("unexpected slowest tests %v", tests)
+	}
+	var buf bytes.Buffer
+	if err := s.write(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "2.000s  a.TestSlow") || strings.Contains(buf.String(), "TestMedium") {
+		t.Errorf("unexpected report %s", buf.String())
+	}
+
+	start := time.Now()
+	timedOut := []testEvent{
+		{Time: start, Action: "run", Package: "a", Test: "TestFail"},
+		{Time: start.Add(2 * time.Second), Action: "fail", Package: "a", Test: "TestFail", Elapsed: 2},
+		{Time: start.Add(2 * time.Second), Action: "run", Package: "a", Test: "TestHang"},
+		{Time: start.Add(10 * time.Second), Action: "output", Package: "a", Output: "panic: test timed out after 10s\n"},
+		{Time: start.Add(10 * time.Second), Action: "fail", Package: "a", Elapsed: 10},
+	}
+	if slow := slowTests(timedOut, time.Second); len(slow) != 2 || !strings.HasPrefix(slow[1], "TestHang (8.000s") {
+		t.Errorf("expected failed and timed out tests to be slow: %v", slow)
+	}
+}
+
+func TestRacesFromEvents(t *testing.T) {
+	raceOutput := func(addr string) []testEvent {
+		lines := []string{
+			"==================",
+			"WARNING: DATA RACE",
+			"Read at " + addr + " by goroutine 8:",
+			"  a.TestRace.func1()",
+			"      /src/a/a_test.go:9 +0x33",
+			"",
+			"Previous write at " + addr + " by goroutine 7:",
+			"  a.TestRace()",
+			"      /src/a/a_test.go:10 +0x138",
+			"",
+			"Goroutine 8 (running) created at:",
+			"  a.TestRace()",
+			"      /src/a/a_test.go:9 +0x11c",
+			"==================",
+		}
+		events := make([]testEvent, 0, len(lines))
+		for _, line := range lines {
+			events = append(events, testEvent{Action: "output", Package: "a", Test: "TestRace", Output: line + "\n"})
+		}
+		return events
+	}
+	r := raceReport{}
+	r.add(racesFromEvents(raceOutput("0x00c0000182c8")))
+	r.add(racesFromEvents(raceOutput("0x00c0000199a0")))
+	if len(r.races) != 1 || r.races[0].Count != 2 {
+		t.Fatalf("expected one race seen twice, got %v", r.races)
+	}
+	race := r.races[0]
+	if len(race.Accesses) != 2 || race.Accesses[1].Header != "Previous write by goroutine 7" {
+		t.Errorf("unexpected accesses %v", race.Accesses)
+	}
+	if race.Accesses[0].Frames[0] != "a.TestRace.func1() /src/a/a_test.go:9" {
+		t.Errorf("unexpected frame %s", race.Accesses[0].Frames[0])
+	}
+	if len(race.Created) != 1 || race.Created[0].Header != "goroutine 8 created" {
+		t.Errorf("unexpected created stacks %v", race.Created)
+	}
+}
+
+func TestCrashFromEvents(t *testing.T) {
+	lines := []string{
+		"=== RUN   TestHang",
+		"panic: test timed out after 1s",
+		"\trunning tests:",
+		"\t\tTestHang (1s)",
+		"",
+		"goroutine 8 [running]:",
+		"testing.(*M).startAlarm.func1()",
+		"\t/usr/local/go/src/testing/testing.go:2959 +0x34a",
+		"",
+		"goroutine 7 [sleep]:",
+		"time.Sleep(0xdf8475800)",
+		"\t/usr/local/go/src/runtime/time.go:368 +0x165",
+		"a.TestHang(0x386499158488?)",
+		"\t/src/a/a_test.go:6 +0x1d",
+		"testing.tRunner(0x386499158488, 0x6d4778)",
+		"\t/usr/local/go/src/testing/testing.go:2193 +0xea",
+	}
+	events := []testEvent{{Action: "run", Package: "a", Test: "TestHang"}}
+	for _, line := range lines {
+		events = append(events, testEvent{Action: "output", Package: "a", Test: "TestHang", Output: line + "\n"})
+	}
+	events = append(events, testEvent{Action: "output", Package: "a", Output: "FAIL\ta\t1.006s\n"}, testEvent{Action: "fail", Package: "a"})
+	crash := crashFromEvents(events)
+	if crash == nil {
+		t.Fatal("expected a crash")
+	}
+	if crash.String() != "TestHang timed out after 1s" {
+		t.Errorf("unexpected crash %s", crash)
+	}
+	if len(crash.dump) != len(lines)-1 {
+		t.Errorf("unexpected dump length %d", len(crash.dump))
+	}
+	frames := crash.topFrames(crashFrames)
+	expected := []string{"time.Sleep() /usr/local/go/src/runtime/time.go:368", "a.TestHang() /src/a/a_test.go:6"}
+	if strings.Join(frames, "|") != strings.Join(expected, "|") {
+		t.Errorf("unexpected frames %v", frames)
+	}
+}
+
+func TestHasBuildTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobuild-integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	files := map[string]string{
+		"go_build_test.go":   "//go:build integration && " + runtime.GOOS + "\n\npackage a\n",
+		"plus_build_test.go": "// +build integration\n\npackage a\n",
+		"other_test.go":      "//go:build build\n\npackage a\n\n//go:build integration\n",
+		"not_test.go":        "//go:build !integration\n\npackage a\n",
+		"either_test.go":     "//go:build integration || !integration\n\npackage a\n",
+		"windows_test.go":    "//go:build integration && !" + runtime.GOOS + "\n\npackage a\n",
+	}
+	for name, src := range files {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		tagged, err := hasBuildTag(filename, []string{"integration"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tagged != (name == "go_build_test.go" || name == "plus_build_test.go") {
+			t.Errorf("unexpected tagged=%t for %s", tagged, name)
+		}
+	}
+}
+
+func TestHooksFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobuild-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"gobuild.toml":   "[hooks]\n  preTest = [[\"start\"]]\n",
+		"a/a.go":         "package a\n",
+		"b/gobuild.toml": "[hooks]\n  preTest = [[\"gen\", \"b\"]]\n",
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := gobuildMain{
+		tc: templateCache{
+			cache:      make(map[string]*buildTemplate),
+			verboseLog: log.New(ioutil.Discard, "", 0),
+		},
+	}
+	hooks, err := g.hooksFor([]string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}, hookName("pre", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0].dir != dir || hooks[1].dir != filepath.Join(dir, "b") || hooks[1].args[1] != "b" {
+		t.Errorf("unexpected hooks %v", hooks)
+	}
+
+	for name := range g.checkPhases() {
+		if !contains(hookedCommands, name) {
+			t.Errorf("check phase %s is missing from hookedCommands", name)
+		}
+	}
+	misspelled := buildTemplate{Hooks: map[string][][]string{"pre_biuld": {{"gen"}}, "preBuild": {{"gen"}}}}
+	err = misspelled.resolveHooks(dir)
+	if err == nil || !strings.Contains(err.Error(), "unknown hooks pre_biuld") || !strings.Contains(err.Error(), "preBuild, postBuild") {
+		t.Errorf("expected an unknown hook error listing the valid hooks, got %v", err)
+	}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	block := func(line int, count int) cover.ProfileBlock {
+		return cover.ProfileBlock{StartLine: line, StartCol: 1, EndLine: line + 1, EndCol: 2, NumStmt: 1, Count: count}
+	}
+	a := &cover.Profile{FileName: "a.go", Mode: "count", Blocks: []cover.ProfileBlock{block(1, 2), block(5, 0)}}
+	b := &cover.Profile{FileName: "a.go", Mode: "count", Blocks: []cover.ProfileBlock{block(5, 3), block(3, 1)}}
+	merged, err := mergeProfiles([]*cover.Profile{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeProfiles(&buf, merged); err != nil {
+		t.Fatal(err)
+	}
+	expected := "mode: count\na.go:1.1,2.2 1 2\na.go:3.1,4.2 1 1\na.go:5.1,6.2 1 3\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected merged profile %q", buf.String())
+	}
+
+	setA := &cover.Profile{FileName: "a.go", Mode: "set", Blocks: []cover.ProfileBlock{block(1, 1)}}
+	setB := &cover.Profile{FileName: "a.go", Mode: "set", Blocks: []cover.ProfileBlock{block(1, 1)}}
+	merged, err = mergeProfiles([]*cover.Profile{setA, setB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged[0].Blocks[0].Count != 1 {
+		t.Errorf("set mode counts should be OR-ed, got %d", merged[0].Blocks[0].Count)
+	}
+
+	if _, err := mergeProfiles([]*cover.Profile{a, setA}); err == nil {
+		t.Error("expected an error merging count and set profiles")
+	}
+}
+
+func TestUpdateCoverProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobuild-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	coverprofile := filepath.Join(dir, "coverage.out")
+	retryProfile := coverprofile + ".retry1"
+	write := func(filename string, content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(coverprofile, "mode: count\na.go:1.1,2.2 1 2\na.go:3.1,4.2 1 0\n")
+	// A -run retry of the test that covers lines 3-4
+	write(retryProfile, "mode: count\na.go:1.1,2.2 1 0\na.go:3.1,4.2 1 1\n")
+	if err := updateCoverProfile(coverprofile, retryProfile, false); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := ioutil.ReadFile(coverprofile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(merged) != "mode: count\na.go:1.1,2.2 1 2\na.go:3.1,4.2 1 1\n" {
+		t.Errorf("expected the retry merged with the original counts, got %q", merged)
+	}
+	if _, err := os.Stat(retryProfile); !os.IsNotExist(err) {
+		t.Error("expected the retry profile to be removed")
+	}
+
+	write(retryProfile, "mode: count\na.go:1.1,2.2 1 5\n")
+	if err := updateCoverProfile(coverprofile, retryProfile, true); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := ioutil.ReadFile(coverprofile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(replaced) != "mode: count\na.go:1.1,2.2 1 5\n" {
+		t.Errorf("expected a package rerun to replace the profile, got %q", replaced)
+	}
+	if err := updateCoverProfile(coverprofile, retryProfile, false); err != nil {
+		t.Errorf("a retry without a profile should be ignored, got %v", err)
+	}
+}
+
+func TestCoverPackages(t *testing.T) {
+	for src, expected := range map[string]string{
+		"":                                "",
+		"[test]\ncoverpkg = \"module\"\n": "module",
+		"[test]\ncoverpkg = [\"a/...\", \"b\"]\n": "a/...,b",
+	} {
+		tmpl := buildTemplate{}
+		tmpl.MergeFrom(&defaultLoadedTemplate)
+		child := buildTemplate{}
+		if _, err := toml.Decode(src, &child); err != nil {
+			t.Fatal(err)
+		}
+		tmpl.MergeFrom(&child)
+		if pkgs := strings.Join(tmpl.CoverPackages(), ","); pkgs != expected {
+			t.Errorf("expected coverpkg %s, got %s", expected, pkgs)
+		}
+	}
+}
+
+func TestCoverageBaseline(t *testing.T) {
+	profiles := []*cover.Profile{
+		{FileName: "x/a/a.go", Mode: "set", Blocks: []cover.ProfileBlock{{NumStmt: 3, Count: 1}, {NumStmt: 1, Count: 0}}},
+		{FileName: "x/b/b.go", Mode: "set", Blocks: []cover.ProfileBlock{{NumStmt: 4, Count: 1}}},
+	}
+	current := newCoverageBaseline(profiles)
+	if current.Total != 87.5 || current.Packages["x/a"] != 75 || current.Packages["x/b"] != 100 {
+		t.Fatalf("unexpected coverage %v", current)
+	}
+	baseline := &coverageBaseline{Total: 80, Packages: map[string]float64{"x/a": 80, "x/c": 50}}
+	drops := current.drops(baseline, 1, true)
+	if len(drops) != 1 || !strings.HasPrefix(drops[0], "x/a:") {
+		t.Errorf("unexpected drops %v", drops)
+	}
+	if len(current.drops(baseline, 5, true)) != 0 {
+		t.Error("drops within the tolerance should be allowed")
+	}
+	ratcheted := current.ratchet(baseline, true)
+	if ratcheted.Total != 87.5 || ratcheted.Packages["x/a"] != 80 || ratcheted.Packages["x/b"] != 100 || ratcheted.Packages["x/c"] != 50 {
+		t.Errorf("unexpected ratcheted baseline %v", ratcheted)
+	}
+	subset := &coverageBaseline{Total: 10, Packages: map[string]float64{"x/a": 80}}
+	if drops := subset.drops(baseline, 1, false); len(drops) != 0 {
+		t.Errorf("a subset of the packages should not compare the total: %v", drops)
+	}
+	if current.ratchet(&coverageBaseline{Total: 50}, false).Total != 50 {
+		t.Error("a subset of the packages should not ratchet the total")
+	}
+}
+
+func TestVarNumber(t *testing.T) {
+	var tmpl buildTemplate
+	if _, err := toml.Decode("[vars]\n  a = 1\n  b = 2.5\n  c = \"3\"\n", &tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := tmpl.varNumber("a"); err != nil || a != 1 {
+		t.Errorf("expected an integer var to be read, got %f %v", a, err)
+	}
+	if b, err := tmpl.varNumber("b"); err != nil || b != 2.5 {
+		t.Errorf("expected a float var to be read, got %f %v", b, err)
+	}
+	if _, err := tmpl.varNumber("c"); err == nil {
+		t.Error("expected an error for a string var")
+	}
+}
+
+func TestPatchCoverage(t *testing.T) {
+	top := realPath(os.TempDir())
+	diff := `diff --git a/x/a.go b/x/a.go
+--- a/x/a.go
++++ b/x/a.go
+@@ -3,0 +4,2 @@ func A() {
++	a()
++	b()
+@@ -10 +12 @@ func B() {
+-	old()
++	c()
+diff --git a/x/gone.go b/x/gone.go
+--- a/x/gone.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package x
+diff --git "a/x/caf\303\251.go" "b/x/caf\303\251.go"
+--- "a/x/caf\303\251.go"
++++ "b/x/caf\303\251.go"
+@@ -1,0 +2 @@
++var x = 1
+`
+	changed := make(changedLines)
+	if err := parseUnifiedDiff(strings.NewReader(diff), top, changed); err != nil {
+		t.Fatal(err)
+	}
+	filename := realPath(filepath.Join(top, "x", "a.go"))
+	if len(changed) != 2 || len(changed[filename]) != 3 || len(changed[realPath(filepath.Join(top, "x", "café.go"))]) != 1 {
+		t.Fatalf("unexpected changed lines %v", changed)
+	}
+	delete(changed, realPath(filepath.Join(top, "x", "café.go")))
+	if len(changed.inDirs([]string{filepath.Join(top, "y")})) != 0 || len(changed.inDirs([]string{filepath.Join(top, "x")})) != 1 {
+		t.Error("expected only changes in the tested directories")
+	}
+	profiles := []*cover.Profile{{FileName: "example.com/x/a.go", Mode: "set", Blocks: []cover.ProfileBlock{
+		{StartLine: 3, EndLine: 4, NumStmt: 1, Count: 1},
+		{StartLine: 5, EndLine: 5, NumStmt: 1, Count: 0},
+		{StartLine: 11, EndLine: 13, NumStmt: 1, Count: 0},
+	}}}
+	patch := computePatchCoverage(profiles, map[string]string{"example.com/x": filepath.Join(top, "x")}, changed, top)
+	expected := []string{filepath.Join("x", "a.go") + ":5", filepath.Join("x", "a.go") + ":12"}
+	if patch.covered != 1 || strings.Join(patch.uncovered, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected patch coverage %d %v", patch.covered, patch.uncovered)
+	}
+
+	dir, err := ioutil.TempDir("", "TestPatchCoverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	untested := filepath.Join(dir, "u.go")
+	src := "package u\n\nfunc U(a int) int {\n\tif a > 0 {\n\t\treturn f(a,\n\t\t\t1)\n\t}\n\n\treturn 0\n}\n"
+	if err := ioutil.WriteFile(untested, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := unrunProfile(untested, "example.com/u/u.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(changedLines)
+	if err := lines.addWholeFile(untested); err != nil {
+		t.Fatal(err)
+	}
+	patch = computePatchCoverage([]*cover.Profile{p}, map[string]string{"example.com/u": dir}, lines, dir)
+	if patch.covered != 0 || strings.Join(patch.uncovered, ",") != "u.go:4,u.go:5,u.go:6,u.go:9" {
+		t.Errorf("unexpected untested patch coverage %d %v", patch.covered, patch.uncovered)
+	}
+}
+
+func TestCobertura(t *testing.T) {
+	profiles := []*cover.Profile{{FileName: "example.com/x/a.go", Mode: "count", Blocks: []cover.ProfileBlock{
+		{StartLine: 3, EndLine: 5, NumStmt: 2, Count: 2},
+		{StartLine: 5, EndLine: 6, NumStmt: 1, Count: 0},
+	}}}
+	source := realPath(os.TempDir())
+	c := newCobertura(profiles, map[string]string{"example.com/x": filepath.Join(source, "x")}, source, time.Unix(1, 0))
+	if c.LinesValid != 4 || c.LinesCovered != 3 || c.LineRate != "0.7500" || c.Timestamp != 1000 {
+		t.Errorf("unexpected totals %+v", c)
+	}
+	if len(c.Packages) != 1 || len(c.Packages[0].Classes) != 1 {
+		t.Fatalf("unexpected packages %+v", c.Packages)
+	}
+	class := c.Packages[0].Classes[0]
+	if class.Filename != "x/a.go" || len(class.Lines) != 4 || class.Lines[2].Hits != 2 || class.Lines[3].Hits != 0 {
+		t.Errorf("unexpected class %+v", class)
+	}
+	var buf bytes.Buffer
+	if err := writeCobertura(&buf, c); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<line number="5" hits="2"></line>`) {
+		t.Errorf("unexpected cobertura XML %s", buf.String())
+	}
+	for rel, outside := range map[string]bool{"..": true, filepath.Join("..", "a.go"): true, filepath.Join("..foo", "a.go"): false, "a.go": false} {
+		if outsideDir(rel) != outside {
+			t.Errorf("expected outsideDir(%s) = %t", rel, outside)
+		}
+	}
+}
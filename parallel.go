@@ -0,0 +1,78 @@
+package main
+
+import "sync/atomic"
+
+// runOrdered calls work for every index in [0, n) using at most workers goroutines.  finish is
+// called from the calling goroutine for each index in increasing order, as soon as work for that
+// index and every index before it has completed.  This lets callers run directories in parallel
+// while still reporting their output and errors in a deterministic order.
+//
+// If failFast is set, indexes that have not started by the time any work returns an error are
+// skipped: neither work nor finish is called for them.
+func runOrdered(workers int, n int, failFast bool, work func(i int) error, finish func(i int)) {
+	if n == 0 {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	var failed int32
+	ran := make([]bool, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				if !failFast || atomic.LoadInt32(&failed) == 0 {
+					ran[i] = true
+					if err := work(i); err != nil {
+						atomic.StoreInt32(&failed, 1)
+					}
+				}
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			next <- i
+		}
+		close(next)
+	}()
+	for i := 0; i < n; i++ {
+		<-done[i]
+		if ran[i] {
+			finish(i)
+		}
+	}
+}
+
+// workerBudget limits how much work runs at once across every runOrdered call that shares it, so
+// check phases running side by side together stay within -j
+type workerBudget chan struct{}
+
+func newWorkerBudget(workers int) workerBudget {
+	if workers < 1 {
+		workers = 1
+	}
+	return make(workerBudget, workers)
+}
+
+// limit wraps work so every call holds one of the budget's workers while it runs.  A nil budget
+// does not limit work.
+func (b workerBudget) limit(work func(i int) error) func(i int) error {
+	if b == nil {
+		return work
+	}
+	return func(i int) error {
+		b <- struct{}{}
+		defer func() { <-b }()
+		return work(i)
+	}
+}
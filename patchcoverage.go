@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+	"github.com/cep21/gobuild/internal/golang.org/x/tools/cover"
+)
+
+// diffHunkLine is the header of a `git diff -U0` hunk, like "@@ -10,2 +12,3 @@"
+var diffHunkLine = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// changedLines maps the real path of each file to the line numbers added or modified in it
+type changedLines map[string]map[int]struct{}
+
+func (c changedLines) add(filename string, line int) {
+	if c[filename] == nil {
+		c[filename] = make(map[int]struct{})
+	}
+	c[filename][line] = struct{}{}
+}
+
+// gitUnquote undoes git's quoting of file names with unusual characters, like "b/caf\303\251.go"
+func gitUnquote(name string) string {
+	if !strings.HasPrefix(name, `"`) {
+		return name
+	}
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		return unquoted
+	}
+	return name
+}
+
+// parseUnifiedDiff reads the added and modified lines from `git diff -U0` output.  File names are
+// joined to top.
+func parseUnifiedDiff(r io.Reader, top string, into changedLines) error {
+	s := bufio.NewScanner(r)
+	current := ""
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			current = ""
+			if name := gitUnquote(strings.TrimPrefix(line, "+++ ")); strings.HasPrefix(name, "b/") {
+				current = realPath(filepath.Join(top, filepath.FromSlash(strings.TrimPrefix(name, "b/"))))
+			}
+		case current != "" && diffHunkLine.MatchString(line):
+			m := diffHunkLine.FindStringSubmatch(line)
+			start, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+			for i := 0; i < count; i++ {
+				into.add(current, start+i)
+			}
+		}
+	}
+	return s.Err()
+}
+
+// inDirs returns the changed lines of files directly in one of dirs
+func (c changedLines) inDirs(dirs []string) changedLines {
+	keep := make(map[string]struct{}, len(dirs))
+	for _, dir := range dirs {
+		keep[realPath(dir)] = struct{}{}
+	}
+	ret := make(changedLines, len(c))
+	for filename, lines := range c {
+		if _, exists := keep[filepath.Dir(filename)]; exists {
+			ret[filename] = lines
+		}
+	}
+	return ret
+}
+
+// addWholeFile marks every line of filename as changed, for files git does not track yet
+func (c changedLines) addWholeFile(filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return wraperr(err, "cannot read %s", filename)
+	}
+	lines := bytes.Count(contents, []byte("\n"))
+	if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		lines++
+	}
+	for i := 1; i <= lines; i++ {
+		c.add(realPath(filename), i)
+	}
+	return nil
+}
+
+// gitChangedLines returns the go file lines changed in the working tree since the merge base of ref
+// and HEAD, including every line of untracked files
+func gitChangedLines(ctx context.Context, ref string) (changedLines, string, error) {
+	top, err := gitOutput(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, "", wraperr(err, "cannot find git root")
+	}
+	base, err := gitMergeBase(ctx, ref)
+	if err != nil {
+		return nil, "", wraperr(err, "cannot find merge base of %s", ref)
+	}
+	diff, err := gitOutput(ctx, "-c", "core.quotePath=false", "-C", top, "diff", "-U0", "--no-color", "--no-ext-diff", base, "--", "*.go")
+	if err != nil {
+		return nil, "", wraperr(err, "cannot diff against %s", base)
+	}
+	ret := make(changedLines)
+	if err := parseUnifiedDiff(strings.NewReader(diff), top, ret); err != nil {
+		return nil, "", wraperr(err, "cannot parse diff against %s", base)
+	}
+	untracked, err := gitOutput(ctx, "-c", "core.quotePath=false", "-C", top, "ls-files", "--others", "--exclude-standard", "--", "*.go")
+	if err != nil {
+		return nil, "", wraperr(err, "cannot list untracked files")
+	}
+	for _, name := range strings.Split(untracked, "\n") {
+		if name == "" {
+			continue
+		}
+		if err := ret.addWholeFile(filepath.Join(top, filepath.FromSlash(gitUnquote(name)))); err != nil {
+			return nil, "", err
+		}
+	}
+	return ret, realPath(top), nil
+}
+
+// patchCoverage is the coverage of the changed lines that hold statements
+type patchCoverage struct {
+	covered   int
+	uncovered []string
+}
+
+func (p *patchCoverage) percent() float64 {
+	total := p.covered + len(p.uncovered)
+	if total == 0 {
+		return 100
+	}
+	return float64(p.covered) / float64(total) * 100
+}
+
+func (p *patchCoverage) write(w io.Writer) error {
+	lines := []string{fmt.Sprintf("patch coverage: %.1f%% of %d changed lines", p.percent(), p.covered+len(p.uncovered))}
+	if len(p.uncovered) > 0 {
+		lines = append(lines, "uncovered changed lines:")
+		for _, u := range p.uncovered {
+			lines = append(lines, "  "+u)
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// computePatchCoverage intersects changed with the blocks of profiles.  A changed line is covered
+// if a block that ran includes it, and uncovered if it is only in blocks that did not run.
+// fileDirs maps each profile's package import path to its directory.  Uncovered lines are listed
+// relative to top.
+func computePatchCoverage(profiles []*cover.Profile, fileDirs map[string]string, changed changedLines, top string) *patchCoverage {
+	ret := &patchCoverage{}
+	for _, p := range profiles {
+		dir, exists := fileDirs[path.Dir(p.FileName)]
+		if !exists {
+			continue
+		}
+		filename := realPath(filepath.Join(dir, path.Base(p.FileName)))
+		lines := changed[filename]
+		if len(lines) == 0 {
+			continue
+		}
+		covered := make(map[int]bool, len(lines))
+		for _, b := range p.Blocks {
+			for line := b.StartLine; line <= b.EndLine; line++ {
+				if _, exists := lines[line]; exists {
+					covered[line] = covered[line] || b.Count > 0
+				}
+			}
+		}
+		name := filename
+		if rel, err := filepath.Rel(top, filename); err == nil {
+			name = rel
+		}
+		sortedLines := make([]int, 0, len(covered))
+		for line := range covered {
+			sortedLines = append(sortedLines, line)
+		}
+		sort.Ints(sortedLines)
+		for _, line := range sortedLines {
+			if covered[line] {
+				ret.covered++
+			} else {
+				ret.uncovered = append(ret.uncovered, fmt.Sprintf("%s:%d", name, line))
+			}
+		}
+	}
+	return ret
+}
+
+// untestedProfiles returns a profile, where no statement ran, for each changed file of a package
+// without a profile, such as a new package with no tests.  Otherwise a patch adding an untested
+// package would be fully covered.  fileDirs gets the directories of those packages.
+func untestedProfiles(ctx context.Context, profiles []*cover.Profile, fileDirs map[string]string, changed changedLines, chunkSize int) ([]*cover.Profile, error) {
+	profiled := make(map[string]struct{}, len(profiles))
+	for _, p := range profiles {
+		if dir, exists := fileDirs[path.Dir(p.FileName)]; exists {
+			profiled[realPath(filepath.Join(dir, path.Base(p.FileName)))] = struct{}{}
+		}
+	}
+	dirSet := make(map[string]struct{}, len(changed))
+	for filename := range changed {
+		if _, exists := profiled[filename]; !exists {
+			dirSet[filepath.Dir(filename)] = struct{}{}
+		}
+	}
+	if len(dirSet) == 0 {
+		return nil, nil
+	}
+	dirs := make([]string, 0, len(dirSet))
+	for dir := range dirSet {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	pkgs, err := listPackages(ctx, dirs, chunkSize)
+	if err != nil {
+		return nil, wraperr(err, "cannot list packages of untested changes")
+	}
+	ret := make([]*cover.Profile, 0, len(changed))
+	for _, pkg := range pkgs {
+		for _, name := range pkg.GoFiles {
+			filename := realPath(filepath.Join(pkg.Dir, name))
+			if _, exists := changed[filename]; !exists {
+				continue
+			}
+			if _, exists := profiled[filename]; exists {
+				continue
+			}
+			p, err := unrunProfile(filename, pkg.ImportPath+"/"+name)
+			if err != nil {
+				return nil, err
+			}
+			fileDirs[pkg.ImportPath] = pkg.Dir
+			ret = append(ret, p)
+		}
+	}
+	return ret, nil
+}
+
+// unrunProfile is the cover profile of filename if none of its statements ran.  Each statement is
+// a block of the lines it spans, or just its first line if it holds other statements.
+func unrunProfile(filename string, profileName string) (*cover.Profile, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		return nil, wraperr(err, "cannot parse %s", filename)
+	}
+	ret := &cover.Profile{FileName: profileName, Mode: "set"}
+	ast.Inspect(f, func(n ast.Node) bool {
+		stmt, isStmt := n.(ast.Stmt)
+		if !isStmt {
+			return true
+		}
+		start, end := fset.Position(stmt.Pos()).Line, fset.Position(stmt.End()).Line
+		switch stmt.(type) {
+		case *ast.BlockStmt, *ast.LabeledStmt, *ast.EmptyStmt, *ast.CaseClause, *ast.CommClause:
+			return true
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			end = start
+		}
+		ret.Blocks = append(ret.Blocks, cover.ProfileBlock{StartLine: start, EndLine: end, NumStmt: 1})
+		return true
+	})
+	return ret, nil
+}
+
+// checkPatchCoverage reports the coverage, in the merged profile coverageFilename, of lines changed
+// since the git ref since in testedDirs.  Changes elsewhere, such as on another shard, are left
+// out.  It fails if that is below required.
+func checkPatchCoverage(ctx context.Context, coverageFilename string, since string, testedDirs []string, chunkSize int, required float64, out io.Writer) error {
+	profiles, err := cover.ParseProfiles(coverageFilename)
+	if err != nil {
+		return wraperr(err, "cannot parse coverage profile file %s", coverageFilename)
+	}
+	changed, top, err := gitChangedLines(ctx, since)
+	if err != nil {
+		return err
+	}
+	changed = changed.inDirs(testedDirs)
+	fileDirs, err := profileDirs(ctx, profiles, chunkSize)
+	if err != nil {
+		return err
+	}
+	untested, err := untestedProfiles(ctx, profiles, fileDirs, changed, chunkSize)
+	if err != nil {
+		return err
+	}
+	patch := computePatchCoverage(append(profiles, untested...), fileDirs, changed, top)
+	if err := patch.write(out); err != nil {
+		return wraperr(err, "cannot write patch coverage")
+	}
+	if patch.percent()+.001 < required {
+		return fmt.Errorf("patch coverage %f < required %f", patch.percent(), required)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// phaseGraph runs check phases concurrently, starting each phase once every phase it depends on
+// has passed.  Exclusive phases run while no other phase is running.
+type phaseGraph struct {
+	phases    []string
+	depends   map[string][]string
+	exclusive map[string]bool
+	run       func(ctx context.Context, phase string) error
+	failFast  bool
+
+	verboseLog logger
+}
+
+type phaseResult struct {
+	name       string
+	err        error
+	skipReason string
+	// cancelled is set if the phase was stopped because another phase failed
+	cancelled bool
+	start     time.Time
+	end       time.Time
+	// gatedBy is the dependency that finished last before this phase started
+	gatedBy *phaseResult
+}
+
+func (p *phaseResult) duration() time.Duration {
+	return p.end.Sub(p.start)
+}
+
+func (p *phaseResult) status() string {
+	switch {
+	case p.skipReason != "":
+		return "skipped"
+	case p.cancelled:
+		return "cancelled"
+	case p.err != nil:
+		return "fail"
+	default:
+		return "pass"
+	}
+}
+
+// activeDepends returns the dependencies of phase that are part of this run
+func (g *phaseGraph) activeDepends(phase string) []string {
+	ret := make([]string, 0, len(g.depends[phase]))
+	for _, dep := range g.depends[phase] {
+		for _, p := range g.phases {
+			if p == dep {
+				ret = append(ret, dep)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// validate returns an error if the dependencies between phases contain a cycle
+func (g *phaseGraph) validate() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(g.phases))
+	var visit func(phase string, path []string) error
+	visit = func(phase string, path []string) error {
+		path = append(path, phase)
+		switch state[phase] {
+		case visiting:
+			return fmt.Errorf("check phase dependency cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[phase] = visiting
+		for _, dep := range g.activeDepends(phase) {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[phase] = visited
+		return nil
+	}
+	for _, phase := range g.phases {
+		if err := visit(phase, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run executes every phase and returns their results in the order of g.phases
+func (g *phaseGraph) Run(ctx context.Context) ([]*phaseResult, error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(map[string]*phaseResult, len(g.phases))
+	done := make(map[string]chan struct{}, len(g.phases))
+	for _, phase := range g.phases {
+		results[phase] = &phaseResult{name: phase}
+		done[phase] = make(chan struct{})
+	}
+	var failedMu sync.Mutex
+	failed := false
+	// Phases hold a read lock while they run and exclusive phases hold the write lock
+	var running sync.RWMutex
+
+	wg := sync.WaitGroup{}
+	for _, phase := range g.phases {
+		wg.Add(1)
+		go func(phase string) {
+			defer wg.Done()
+			defer close(done[phase])
+			r := results[phase]
+			for _, dep := range g.activeDepends(phase) {
+				<-done[dep]
+				depResult := results[dep]
+				if depResult.status() != "pass" && r.skipReason == "" {
+					r.skipReason = fmt.Sprintf("%s %s", dep, depResult.status())
+				}
+				if r.gatedBy == nil || depResult.end.After(r.gatedBy.end) {
+					r.gatedBy = depResult
+				}
+			}
+			if r.skipReason == "" {
+				if g.exclusive[phase] {
+					running.Lock()
+					defer running.Unlock()
+				} else {
+					running.RLock()
+					defer running.RUnlock()
+				}
+			}
+			failedMu.Lock()
+			if failed && g.failFast && r.skipReason == "" {
+				r.skipReason = "an earlier phase failed"
+			}
+			failedMu.Unlock()
+			r.start = time.Now()
+			if r.skipReason != "" {
+				r.end = r.start
+				g.verboseLog.Printf("Skipping check phase %s: %s", phase, r.skipReason)
+				return
+			}
+			g.verboseLog.Printf("Running check phase %s", phase)
+			r.err = g.run(ctx, phase)
+			r.end = time.Now()
+			if r.err != nil {
+				failedMu.Lock()
+				// An error after another phase failed fast is most likely from the cancel
+				r.cancelled = g.failFast && failed
+				failed = true
+				failedMu.Unlock()
+				if g.failFast {
+					cancel()
+				}
+			}
+		}(phase)
+	}
+	wg.Wait()
+
+	ret := make([]*phaseResult, 0, len(g.phases))
+	for _, phase := range g.phases {
+		ret = append(ret, results[phase])
+	}
+	return ret, nil
+}
+
+// criticalPath returns the chain of phases, ending with the last phase to finish, where each
+// phase was held up by the one before it.  Skipped and cancelled phases are not on it.
+func criticalPath(results []*phaseResult) []*phaseResult {
+	var last *phaseResult
+	for _, r := range results {
+		if r.skipReason != "" || r.cancelled {
+			continue
+		}
+		if last == nil || r.end.After(last.end) {
+			last = r
+		}
+	}
+	ret := []*phaseResult{}
+	for r := last; r != nil; r = r.gatedBy {
+		ret = append([]*phaseResult{r}, ret...)
+	}
+	return ret
+}
+
+func writePhaseSummary(w io.Writer, results []*phaseResult) error {
+	lines := make([]string, 0, len(results)+2)
+	lines = append(lines, "check summary:")
+	for _, r := range results {
+		line := fmt.Sprintf("  %-8s %-9s %s", r.name, r.status(), r.duration().Round(time.Millisecond).String())
+		if r.skipReason != "" {
+			line = fmt.Sprintf("  %-8s %-9s (%s)", r.name, r.status(), r.skipReason)
+		}
+		lines = append(lines, line)
+	}
+	path := criticalPath(results)
+	if len(path) > 0 {
+		parts := make([]string, 0, len(path))
+		for _, r := range path {
+			parts = append(parts, fmt.Sprintf("%s (%s)", r.name, r.duration().Round(time.Millisecond).String()))
+		}
+		lines = append(lines, fmt.Sprintf("critical path: %s = %s", strings.Join(parts, " -> "), path[len(path)-1].end.Sub(path[0].start).Round(time.Millisecond).String()))
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	raceStart     = "WARNING: DATA RACE"
+	raceSeparator = "=================="
+)
+
+var (
+	// raceAccessLine looks like "Previous write at 0x00c0000182c8 by goroutine 7:"
+	raceAccessLine = regexp.MustCompile(`^(.+) at 0x[0-9a-f]+ by (goroutine \d+|main goroutine):$`)
+	// raceCreatedLine looks like "Goroutine 8 (running) created at:"
+	raceCreatedLine = regexp.MustCompile(`^Goroutine (\d+) \((\w+)\) created at:$`)
+	// frameOffset is the "+0x33" program counter offset after a frame's file and line
+	frameOffset = regexp.MustCompile(` \+0x[0-9a-f]+$`)
+)
+
+// raceStack is one section of a race report: an access or where a goroutine was created
+type raceStack struct {
+	Header string   `json:"header"`
+	Frames []string `json:"frames"`
+}
+
+// dataRace is a race report.  Reports with the same access stacks are the same race.
+type dataRace struct {
+	Signature string      `json:"signature"`
+	Package   string      `json:"package"`
+	Tests     []string    `json:"tests"`
+	Count     int         `json:"count"`
+	Accesses  []raceStack `json:"accesses"`
+	Created   []raceStack `json:"created"`
+}
+
+// parseRace parses the lines between "WARNING: DATA RACE" and the closing separator
+func parseRace(lines []string) dataRace {
+	r := dataRace{}
+	var cur *raceStack
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			cur = nil
+		case raceAccessLine.MatchString(trimmed):
+			m := raceAccessLine.FindStringSubmatch(trimmed)
+			r.Accesses = append(r.Accesses, raceStack{Header: m[1] + " by " + m[2]})
+			cur = &r.Accesses[len(r.Accesses)-1]
+		case raceCreatedLine.MatchString(trimmed):
+			m := raceCreatedLine.FindStringSubmatch(trimmed)
+			r.Created = append(r.Created, raceStack{Header: "goroutine " + m[1] + " created"})
+			cur = &r.Created[len(r.Created)-1]
+		case cur == nil:
+		case strings.HasPrefix(line, "      ") && len(cur.Frames) > 0:
+			// The file and line of the function on the line before
+			last := len(cur.Frames) - 1
+			cur.Frames[last] += " " + frameOffset.ReplaceAllString(trimmed, "")
+		default:
+			cur.Frames = append(cur.Frames, trimmed)
+		}
+	}
+	r.Signature = raceSignature(r.Accesses)
+	return r
+}
+
+// raceSignature hashes the access kinds and frames, leaving out addresses and goroutine ids
+// that change each run
+func raceSignature(accesses []raceStack) string {
+	h := sha256.New()
+	for _, a := range accesses {
+		kind := a.Header
+		if i := strings.Index(kind, " by "); i >= 0 {
+			kind = kind[:i]
+		}
+		fmt.Fprintln(h, kind)
+		for _, f := range a.Frames {
+			fmt.Fprintln(h, f)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// racesFromEvents finds every data race report in the output of events
+func racesFromEvents(events []testEvent) []dataRace {
+	ret := make([]dataRace, 0, 1)
+	var lines []string
+	inRace := false
+	test := ""
+	for _, ev := range events {
+		if ev.Action != "output" {
+			continue
+		}
+		line := strings.TrimSuffix(ev.Output, "\n")
+		switch {
+		case line == raceStart:
+			inRace = true
+			lines = lines[:0]
+			test = ev.Test
+		case inRace && line == raceSeparator:
+			inRace = false
+			r := parseRace(lines)
+			r.Package = ev.Package
+			if test != "" {
+				r.Tests = []string{test}
+			}
+			r.Count = 1
+			ret = append(ret, r)
+		case inRace:
+			lines = append(lines, line)
+		}
+	}
+	return ret
+}
+
+// raceReport dedupes data races by signature
+type raceReport struct {
+	races       []*dataRace
+	bySignature map[string]*dataRace
+}
+
+func (r *raceReport) add(races []dataRace) {
+	if r.bySignature == nil {
+		r.bySignature = make(map[string]*dataRace, len(races))
+	}
+	for i := range races {
+		race := races[i]
+		existing, exists := r.bySignature[race.Signature]
+		if !exists {
+			r.bySignature[race.Signature] = &race
+			r.races = append(r.races, &race)
+			continue
+		}
+		existing.Count += race.Count
+		for _, t := range race.Tests {
+			if !contains(existing.Tests, t) {
+				existing.Tests = append(existing.Tests, t)
+			}
+		}
+	}
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes every race, most frequent first
+func (r *raceReport) writeJSON(w io.Writer) error {
+	races := append([]*dataRace{}, r.races...)
+	sort.SliceStable(races, func(i, j int) bool {
+		return races[i].Count > races[j].Count
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(races); err != nil {
+		return wraperr(err, "cannot encode data races")
+	}
+	return nil
+}
+
+// raceSummaryFrames is how many frames of each access are printed in the summary
+const raceSummaryFrames = 2
+
+func (r *raceReport) write(w io.Writer) error {
+	if len(r.races) == 0 {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("data races (%d):", len(r.races))}
+	for _, race := range r.races {
+		lines = append(lines, fmt.Sprintf("  %s in %s %s, seen %d times", race.Signature, race.Package, strings.Join(race.Tests, ","), race.Count))
+		for _, a := range race.Accesses {
+			lines = append(lines, "    "+a.Header)
+			for i, f := range a.Frames {
+				if i == raceSummaryFrames {
+					break
+				}
+				lines = append(lines, "      "+f)
+			}
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// resultCache remembers which phases passed for which directories.  Entries are keyed by a hash of
+// everything that can change the result: the go files of the directory and, for phases that
+// compile, of the non standard packages it depends on, its merged template and the versions of the tools the phase runs.  A nil
+// or disabled cache never reports a hit.
+type resultCache struct {
+	dir        string
+	disabled   bool
+	verboseLog logger
+
+	mu           sync.Mutex
+	toolVersions map[string]string
+}
+
+// sourceOnlyPhases only read the go files of the directories they are given, so their keys skip
+// dependencies
+var sourceOnlyPhases = map[string]struct{}{"dupl": {}}
+
+// key returns the cache key for running phase over dirs with tmpl and tools
+func (r *resultCache) key(ctx context.Context, phase string, dirs []string, tmpl *buildTemplate, tools []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "phase %s\n", phase)
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", wraperr(err, "cannot find abs path of %s", dir)
+		}
+		fmt.Fprintf(h, "dir %s\n", absDir)
+		goFiles, err := filesWithGlobInDir([]string{dir}, "*.go")
+		if err != nil {
+			return "", wraperr(err, "cannot list go files in %s", dir)
+		}
+		for _, goFile := range goFiles {
+			if err := hashFile(h, goFile); err != nil {
+				return "", err
+			}
+		}
+		if _, sourceOnly := sourceOnlyPhases[phase]; sourceOnly {
+			continue
+		}
+		if err := hashDeps(ctx, h, dir, absDir); err != nil {
+			return "", err
+		}
+	}
+	tmplBytes, err := json.Marshal(tmpl)
+	if err != nil {
+		return "", wraperr(err, "cannot encode template for hashing")
+	}
+	fmt.Fprintf(h, "template %s\n", tmplBytes)
+	sortedTools := append([]string{}, tools...)
+	sort.Strings(sortedTools)
+	for _, tool := range sortedTools {
+		fmt.Fprintf(h, "tool %s %s\n", tool, r.toolVersion(ctx, tool))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashDeps hashes the go files of every non standard package dir depends on, including through
+// its tests, so a change to a dependency is not a cached pass
+func hashDeps(ctx context.Context, h io.Writer, dir string, absDir string) error {
+	deps, err := listDeps(ctx, dir)
+	if err != nil {
+		return wraperr(err, "cannot list dependencies of %s", dir)
+	}
+	seen := map[string]struct{}{absDir: {}}
+	for _, dep := range deps {
+		if _, exists := seen[dep.Dir]; exists || dep.Standard || dep.Dir == "" {
+			continue
+		}
+		seen[dep.Dir] = struct{}{}
+		fmt.Fprintf(h, "dep %s\n", dep.ImportPath)
+		for _, goFile := range dep.GoFiles {
+			if err := hashFile(h, filepath.Join(dep.Dir, goFile)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hashFile(h io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return wraperr(err, "cannot open %s for hashing", filename)
+	}
+	fmt.Fprintf(h, "file %s\n", filepath.Base(filename))
+	_, err = io.Copy(h, f)
+	return multiErr([]error{err, f.Close()})
+}
+
+// toolVersion identifies the installed version of tool.  go reports its own version; other tools
+// are identified by the path, size and modification time of their binary.
+func (r *resultCache) toolVersion(ctx context.Context, tool string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, exists := r.toolVersions[tool]; exists {
+		return v
+	}
+	if r.toolVersions == nil {
+		r.toolVersions = make(map[string]string)
+	}
+	version := "missing"
+	if tool == "go" {
+		if out, err := combinedOutput(ctx, exec.Command("go", "version")); err == nil {
+			version = string(out)
+		}
+	} else if path, err := exec.LookPath(tool); err == nil {
+		version = path
+		if st, err := os.Stat(path); err == nil {
+			version = fmt.Sprintf("%s %d %d", path, st.Size(), st.ModTime().UnixNano())
+		}
+	}
+	r.toolVersions[tool] = version
+	return version
+}
+
+func (r *resultCache) entryFilename(key string) string {
+	return filepath.Join(r.dir, key)
+}
+
+// passed returns true if key was previously marked as passing
+func (r *resultCache) passed(key string) bool {
+	if r == nil || r.disabled {
+		return false
+	}
+	_, err := os.Stat(r.entryFilename(key))
+	return err == nil
+}
+
+// markPassed records that the run identified by key passed
+func (r *resultCache) markPassed(key string) error {
+	if r == nil || r.disabled {
+		return nil
+	}
+	if err := os.MkdirAll(r.dir, 0777); err != nil {
+		return wraperr(err, "cannot create result cache directory %s", r.dir)
+	}
+	f, err := os.Create(r.entryFilename(key))
+	if err != nil {
+		return wraperr(err, "cannot create result cache entry")
+	}
+	return f.Close()
+}
+
+// check returns the key for phase over dirs, and whether that key already passed
+func (r *resultCache) check(ctx context.Context, phase string, dirs []string, tmpl *buildTemplate, tools []string) (string, bool) {
+	if r == nil || r.disabled {
+		return "", false
+	}
+	key, err := r.key(ctx, phase, dirs, tmpl, tools)
+	if err != nil {
+		r.verboseLog.Printf("Unable to hash %s for result cache: %s", phase, err.Error())
+		return "", false
+	}
+	return key, r.passed(key)
+}
+
+// record marks key as passing, if err is nil and check produced a key
+func (r *resultCache) record(key string, err error) {
+	if key == "" || err != nil {
+		return
+	}
+	if err := r.markPassed(key); err != nil {
+		r.verboseLog.Printf("Unable to record result cache entry: %s", err.Error())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// actionQuarantine is a test event gobuild adds for a failed test listed in [test.quarantine].
+// Its Output is the reason given for the quarantine.
+const actionQuarantine = "quarantine"
+
+func topLevelTest(name string) string {
+	return strings.SplitN(name, "/", 2)[0]
+}
+
+// failedTests returns the names of tests in events that failed or never finished
+func failedTests(events []testEvent) []string {
+	finished := make(map[string]string, len(events))
+	order := make([]string, 0, len(events))
+	for _, ev := range events {
+		if ev.Test == "" {
+			continue
+		}
+		switch ev.Action {
+		case "run":
+			if _, exists := finished[ev.Test]; !exists {
+				order = append(order, ev.Test)
+			}
+			finished[ev.Test] = ""
+		case testPass, testFail, testSkip:
+			finished[ev.Test] = ev.Action
+		}
+	}
+	ret := make([]string, 0, 4)
+	for _, name := range order {
+		if status := finished[name]; status == testFail || status == "" {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// quarantinedTests splits the failed tests into top level tests to retry and those whose failures
+// are quarantined.  A top level test is quarantined if it is listed, or if every failed subtest
+// under it is listed.
+func quarantinedTests(failed []string, quarantine map[string]string) (retry []string, quarantined []string) {
+	failedUnder := make(map[string][]string, len(failed))
+	tops := make([]string, 0, len(failed))
+	for _, name := range failed {
+		top := topLevelTest(name)
+		if _, exists := failedUnder[top]; !exists {
+			tops = append(tops, top)
+			failedUnder[top] = []string{}
+		}
+		if name != top {
+			failedUnder[top] = append(failedUnder[top], name)
+		}
+	}
+	sort.Strings(tops)
+	for _, top := range tops {
+		isQuarantined := false
+		if _, exists := quarantine[top]; exists {
+			isQuarantined = true
+		} else if len(failedUnder[top]) > 0 {
+			isQuarantined = true
+			for _, sub := range failedUnder[top] {
+				if _, exists := quarantine[sub]; !exists {
+					isQuarantined = false
+				}
+			}
+		}
+		if isQuarantined {
+			quarantined = append(quarantined, top)
+		} else {
+			retry = append(retry, top)
+		}
+	}
+	return retry, quarantined
+}
+
+// quarantineReason returns the reason a quarantined top level test failure is ignored
+func quarantineReason(top string, failed []string, quarantine map[string]string) string {
+	if reason, exists := quarantine[top]; exists {
+		return reason
+	}
+	for _, name := range failed {
+		if reason, exists := quarantine[name]; exists && topLevelTest(name) == top {
+			return reason
+		}
+	}
+	return ""
+}
+
+func testPackageName(events []testEvent) string {
+	for _, ev := range events {
+		if ev.Package != "" {
+			return ev.Package
+		}
+	}
+	return ""
+}
+
+// runGoTest runs `go test -json` with args and the extra env in dir, writing plain text output to stdout
+func (g *goCoverageCheck) runGoTest(ctx context.Context, dir string, args []string, env []string, stdout io.Writer, stderr io.Writer) ([]testEvent, error) {
+	events := testEventWriter{out: stdout}
+	cmd := exec.Command("go", append([]string{"test", "-json"}, args...)...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = &events
+	cmd.Stderr = stderr
+	cmd.Dir = dir
+	g.verboseLog.Printf("Running [cmd=%s args=%s dir=%s]", cmd.Path, strings.Join(cmd.Args, " "), cmd.Dir)
+	err := runCmd(ctx, cmd)
+	return events.events, multiErr([]error{err, events.Flush()})
+}
+
+// needsPackageRetry is true if a run ended before every test reported a result, such as after a
+// panic, a timeout or a failure in TestMain.  Tests that never started are not in the events, so
+// the whole package has to be rerun.
+func needsPackageRetry(events []testEvent) bool {
+	if crashFromEvents(events) != nil {
+		return true
+	}
+	status := make(map[string]string, len(events))
+	ran, packageFailed, testFailed := false, false, false
+	for _, ev := range events {
+		if ev.Test == "" {
+			packageFailed = packageFailed || ev.Action == testFail
+			continue
+		}
+		switch ev.Action {
+		case "run":
+			ran = true
+			status[ev.Test] = ""
+		case testPass, testFail, testSkip:
+			status[ev.Test] = ev.Action
+			testFailed = testFailed || ev.Action == testFail
+		}
+	}
+	for _, s := range status {
+		if s == "" {
+			return true
+		}
+	}
+	return ran && packageFailed && !testFailed
+}
+
+// retryFailures reruns the failed tests of a package up to the template's retry count.  If the
+// run did not finish, the whole package is rerun instead.  Tests that pass on a retry are
+// recorded as flaky and quarantined failures are ignored.  Each retry writes a cover profile,
+// which is merged into coverprofile.  It returns nil if no unquarantined test is still failing.
+func (g *goCoverageCheck) retryFailures(ctx context.Context, dir string, tmpl *buildTemplate, coverprofile string, r *testResult, runErr error) error {
+	failed := failedTests(r.events)
+	packageFailing := needsPackageRetry(r.events)
+	if (len(failed) == 0 && !packageFailing) || ctx.Err() != nil {
+		// Nothing to retry, such as a build failure
+		return runErr
+	}
+	pkgName := testPackageName(r.events)
+	quarantine := tmpl.Test.Quarantine
+	isQuarantined := make(map[string]struct{}, len(quarantine))
+	remaining := g.quarantineFailures(failed, quarantine, pkgName, isQuarantined, r)
+	retried := false
+	for attempt := 1; attempt <= tmpl.TestRetries() && (len(remaining) > 0 || packageFailing) && ctx.Err() == nil; attempt++ {
+		args := g.testArgs(tmpl)
+		if packageFailing {
+			fmt.Fprintf(&r.stdout, "=== gobuild retry %d of every test\n", attempt)
+		} else {
+			fmt.Fprintf(&r.stdout, "=== gobuild retry %d of %s\n", attempt, strings.Join(remaining, " "))
+			args = append(args, "-run", "^("+strings.Join(quoteAll(remaining), "|")+")$")
+		}
+		retryProfile := fmt.Sprintf("%s.retry%d", coverprofile, attempt)
+		args = append(args, "-coverprofile", retryProfile, ".")
+		events, err := g.runGoTest(ctx, dir, args, g.testEnv(tmpl), &r.stdout, &r.stderr)
+		retried = true
+		for i := range events {
+			events[i].Attempt = attempt
+		}
+		r.events = append(r.events, events...)
+		if perr := updateCoverProfile(coverprofile, retryProfile, packageFailing); perr != nil {
+			return multiErr([]error{runErr, perr})
+		}
+		retryFailed := failedTests(events)
+		if packageFailing {
+			packageFailing = needsPackageRetry(events) || (err != nil && len(retryFailed) == 0)
+		} else if err != nil && len(retryFailed) == 0 {
+			// The retry failed without running tests; count every test as still failing
+			continue
+		}
+		// A whole package rerun can also fail tests that never ran before
+		stillFailing := g.quarantineFailures(retryFailed, quarantine, pkgName, isQuarantined, r)
+		for _, name := range remaining {
+			if !contains(stillFailing, name) {
+				r.flaky = append(r.flaky, fmt.Sprintf("%s (passed on retry %d)", name, attempt))
+			}
+		}
+		remaining = stillFailing
+	}
+	if packageFailing && !retried {
+		return runErr
+	}
+	if packageFailing {
+		return wraperr(runErr, "package still failing")
+	}
+	if len(remaining) > 0 && !retried {
+		return wraperr(runErr, "tests failing: %s", strings.Join(remaining, ", "))
+	}
+	if len(remaining) > 0 {
+		return wraperr(runErr, "tests still failing: %s", strings.Join(remaining, ", "))
+	}
+	return nil
+}
+
+// quarantineFailures records the quarantined top level tests of failed that are not already in
+// isQuarantined and returns the top level tests that are not quarantined
+func (g *goCoverageCheck) quarantineFailures(failed []string, quarantine map[string]string, pkgName string, isQuarantined map[string]struct{}, r *testResult) []string {
+	remaining, quarantined := quarantinedTests(failed, quarantine)
+	for _, name := range quarantined {
+		if _, exists := isQuarantined[name]; exists {
+			continue
+		}
+		isQuarantined[name] = struct{}{}
+		reason := quarantineReason(name, failed, quarantine)
+		r.events = append(r.events, testEvent{Action: actionQuarantine, Package: pkgName, Test: name, Output: reason})
+		if reason == "" {
+			r.quarantined = append(r.quarantined, name)
+		} else {
+			r.quarantined = append(r.quarantined, fmt.Sprintf("%s (%s)", name, reason))
+		}
+	}
+	return remaining
+}
+
+// updateCoverProfile folds the cover profile of a retry into coverprofile.  A rerun of the whole
+// package replaces it.  A rerun of some tests is merged with it, so the coverage of tests that
+// passed the first time is kept.
+func updateCoverProfile(coverprofile string, retryProfile string, replace bool) error {
+	if _, err := os.Stat(retryProfile); os.IsNotExist(err) {
+		// The retry crashed before writing coverage
+		return nil
+	}
+	if replace {
+		if err := os.Rename(retryProfile, coverprofile); err != nil {
+			return wraperr(err, "cannot replace coverprofile %s", coverprofile)
+		}
+		return nil
+	}
+	profiles, err := mergeCoverageFiles([]string{coverprofile, retryProfile})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(coverprofile)
+	if err != nil {
+		return wraperr(err, "cannot rewrite coverprofile %s", coverprofile)
+	}
+	return multiErr([]error{writeProfiles(f, profiles), f.Close(), os.Remove(retryProfile)})
+}
+
+func quoteAll(strs []string) []string {
+	ret := make([]string, 0, len(strs))
+	for _, s := range strs {
+		ret = append(ret, regexp.QuoteMeta(s))
+	}
+	return ret
+}
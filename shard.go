@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// shard identifies which part of the test directories this run is responsible for
+type shard struct {
+	index int
+	total int
+}
+
+func (s shard) enabled() bool {
+	return s.total > 1
+}
+
+// prefix is added to the names of the artifacts a shard writes so shards can be merged later
+func (s shard) prefix() string {
+	if !s.enabled() {
+		return ""
+	}
+	return fmt.Sprintf("shard%d_", s.index)
+}
+
+func (s shard) String() string {
+	return fmt.Sprintf("%d/%d", s.index, s.total)
+}
+
+// parseShard parses a zero based shard of the form index/total
+func parseShard(str string) (shard, error) {
+	parts := strings.Split(str, "/")
+	if len(parts) != 2 {
+		return shard{}, fmt.Errorf("shard %s is not of the form index/total", str)
+	}
+	return newShard(parts[0], parts[1])
+}
+
+func newShard(indexStr string, totalStr string) (shard, error) {
+	index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+	if err != nil {
+		return shard{}, wraperr(err, "invalid shard index %s", indexStr)
+	}
+	total, err := strconv.Atoi(strings.TrimSpace(totalStr))
+	if err != nil {
+		return shard{}, wraperr(err, "invalid shard total %s", totalStr)
+	}
+	if total < 1 || index < 0 || index >= total {
+		return shard{}, fmt.Errorf("shard index %d must be in [0, %d)", index, total)
+	}
+	return shard{index: index, total: total}, nil
+}
+
+// shardFromEnv reads the shard from the environment variables named by the template, returning a
+// disabled shard if they are not set
+func shardFromEnv(tmpl *buildTemplate) (shard, error) {
+	indexStr := os.Getenv(tmpl.varStr("shardIndexEnv"))
+	totalStr := os.Getenv(tmpl.varStr("shardTotalEnv"))
+	if indexStr == "" || totalStr == "" {
+		return shard{}, nil
+	}
+	return newShard(indexStr, totalStr)
+}
+
+// dirs returns the part of dirs this shard should run, balanced by timings
+func (s shard) dirs(dirs []string, timings testTimings) []string {
+	if !s.enabled() {
+		return dirs
+	}
+	return timings.balance(dirs, s.total)[s.index]
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// slowReportSize is how many tests and packages the slow test report lists
+const slowReportSize = 10
+
+type slowEntry struct {
+	name     string
+	duration time.Duration
+}
+
+// slowReport collects test and package durations to list the slowest of each
+type slowReport struct {
+	tests    []slowEntry
+	packages []slowEntry
+}
+
+// add records the duration of pkgs and their top level tests.  Subtests are left out, since
+// their time is already part of their parent's.
+func (s *slowReport) add(pkgs []*packageTests) {
+	for _, pkg := range pkgs {
+		s.packages = append(s.packages, slowEntry{name: pkg.name, duration: pkg.duration})
+		for _, t := range pkg.tests {
+			if topLevelTest(t.name) == t.name {
+				s.tests = append(s.tests, slowEntry{name: pkg.name + "." + t.name, duration: t.duration})
+			}
+		}
+	}
+}
+
+func slowest(entries []slowEntry, n int) []slowEntry {
+	ret := append([]slowEntry{}, entries...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].duration != ret[j].duration {
+			return ret[i].duration > ret[j].duration
+		}
+		return ret[i].name < ret[j].name
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+func writeSlowTable(w io.Writer, title string, entries []slowEntry) error {
+	if _, err := fmt.Fprintf(w, "%s:\n", title); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(tw, "  %.3fs\t  %s\n", e.duration.Seconds(), e.name); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// write prints the n slowest tests and packages as two tables
+func (s *slowReport) write(w io.Writer, n int) error {
+	if len(s.packages) == 0 {
+		return nil
+	}
+	if err := writeSlowTable(w, "slowest tests", slowest(s.tests, n)); err != nil {
+		return wraperr(err, "cannot write slow test report")
+	}
+	if err := writeSlowTable(w, "slowest packages", slowest(s.packages, n)); err != nil {
+		return wraperr(err, "cannot write slow package report")
+	}
+	return nil
+}
+
+// slowTests returns the top level tests in events that ran longer than threshold
+func slowTests(events []testEvent, threshold time.Duration) []string {
+	ret := make([]string, 0, 2)
+	for _, pkg := range packagesFromEvents(events) {
+		for _, t := range pkg.tests {
+			if topLevelTest(t.name) == t.name && t.duration > threshold {
+				ret = append(ret, fmt.Sprintf("%s (%.3fs > %s)", t.name, t.duration.Seconds(), threshold))
+			}
+		}
+	}
+	return ret
+}
+
+// checkSlowTests records tests in dir that ran longer than the template's slowTestThreshold.  They
+// are an error if failSlowTests is set.
+func checkSlowTests(dir string, tmpl *buildTemplate, r *testResult) error {
+	threshold, err := tmpl.SlowTestThreshold()
+	if err != nil {
+		return wraperr(err, "invalid slowTestThreshold for %s", dir)
+	}
+	if threshold <= 0 {
+		return nil
+	}
+	r.slow = slowTests(r.events, threshold)
+	if len(r.slow) > 0 && tmpl.FailSlowTests() {
+		return fmt.Errorf("tests slower than %s in %s: %s", threshold, dir, strings.Join(r.slow, ", "))
+	}
+	return nil
+}
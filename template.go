@@ -1,19 +1,279 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cep21/gobuild/internal/github.com/BurntSushi/toml"
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
 )
 
 type buildTemplate struct {
-	Install    install                `toml:"install"`
-	Metalinter metalinter             `toml:"metalinter"`
-	Vars       map[string]interface{} `toml:"vars"`
-	Fix        fixes                  `toml:"fix"`
+	Install     install                `toml:"install"`
+	Metalinter  metalinter             `toml:"metalinter"`
+	Vars        map[string]interface{} `toml:"vars"`
+	Fix         fixes                  `toml:"fix"`
+	Check       check                  `toml:"check"`
+	Test        testConfig             `toml:"test"`
+	Bench       benchConfig            `toml:"bench"`
+	Fuzz        fuzzConfig             `toml:"fuzz"`
+	Integration integrationConfig      `toml:"integration"`
+	// Hooks are the commands this directory's gobuild.toml runs around each command, by hook name
+	Hooks map[string][][]string `toml:"hooks"`
+
+	// hooks are the hooks of this directory and its parents, in the order they run
+	hooks map[string][]hook
+}
+
+// hook is a command from a [hooks] section, with the directory of the gobuild.toml it came from
+type hook struct {
+	dir  string
+	args []string
+}
+
+// resolveHooks records dir as the origin of the hooks read from its gobuild.toml.  Hooks that no
+// command runs, such as a misspelled name, are an error.
+func (b *buildTemplate) resolveHooks(dir string) error {
+	if len(b.Hooks) > 0 && b.hooks == nil {
+		b.hooks = make(map[string][]hook, len(b.Hooks))
+	}
+	valid := validHookNames()
+	unknown := make([]string, 0, len(b.Hooks))
+	for name, cmds := range b.Hooks {
+		if !contains(valid, name) {
+			unknown = append(unknown, name)
+			continue
+		}
+		for _, args := range cmds {
+			b.hooks[name] = append(b.hooks[name], hook{dir: dir, args: args})
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown hooks %s in %s: valid hooks are %s", strings.Join(unknown, ", "), dir, strings.Join(valid, ", "))
+	}
+	return nil
+}
+
+type integrationConfig struct {
+	Tags    []string          `toml:"tags"`
+	Timeout string            `toml:"timeout"`
+	Env     map[string]string `toml:"env"`
+}
+
+func (c *integrationConfig) MergeFrom(from *integrationConfig) {
+	if from == nil {
+		return
+	}
+	if from.Tags != nil {
+		c.Tags = append([]string{}, from.Tags...)
+	}
+	if from.Timeout != "" {
+		c.Timeout = from.Timeout
+	}
+	if len(from.Env) > 0 && c.Env == nil {
+		c.Env = make(map[string]string, len(from.Env))
+	}
+	for k, v := range from.Env {
+		c.Env[k] = v
+	}
+}
+
+// IntegrationArgs are testFlags with the integration build tags and timeout.  Later flags win, so
+// the integration timeout replaces any -timeout in testFlags.
+func (b *buildTemplate) IntegrationArgs() []string {
+	ret := append([]string{}, b.TestCoverageArgs()...)
+	if len(b.Integration.Tags) > 0 {
+		ret = append(ret, "-tags", strings.Join(b.Integration.Tags, ","))
+	}
+	if b.Integration.Timeout != "" {
+		ret = append(ret, "-timeout", b.Integration.Timeout)
+	}
+	return ret
+}
+
+// IntegrationEnv is the [integration.env] section as KEY=value pairs, sorted by key
+func (b *buildTemplate) IntegrationEnv() []string {
+	ret := make([]string, 0, len(b.Integration.Env))
+	for k, v := range b.Integration.Env {
+		ret = append(ret, k+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+type fuzzConfig struct {
+	Fuzztime string            `toml:"fuzztime"`
+	Parallel *bool             `toml:"parallel"`
+	Targets  map[string]string `toml:"targets"`
+}
+
+func (c *fuzzConfig) MergeFrom(from *fuzzConfig) {
+	if from == nil {
+		return
+	}
+	if from.Fuzztime != "" {
+		c.Fuzztime = from.Fuzztime
+	}
+	if from.Parallel != nil {
+		parallel := *from.Parallel
+		c.Parallel = &parallel
+	}
+	if len(from.Targets) > 0 && c.Targets == nil {
+		c.Targets = make(map[string]string, len(from.Targets))
+	}
+	for k, v := range from.Targets {
+		c.Targets[k] = v
+	}
+}
+
+// FuzzInParallel is true if fuzz targets should run at the same time
+func (b *buildTemplate) FuzzInParallel() bool {
+	return b.Fuzz.Parallel != nil && *b.Fuzz.Parallel
+}
+
+type benchConfig struct {
+	Threshold *float64 `toml:"threshold"`
+	Alpha     *float64 `toml:"alpha"`
+}
+
+func (c *benchConfig) MergeFrom(from *benchConfig) {
+	if from == nil {
+		return
+	}
+	if from.Threshold != nil {
+		threshold := *from.Threshold
+		c.Threshold = &threshold
+	}
+	if from.Alpha != nil {
+		alpha := *from.Alpha
+		c.Alpha = &alpha
+	}
+}
+
+// BenchThreshold is the percent a benchmark can get worse by before it counts as a regression
+func (b *buildTemplate) BenchThreshold() float64 {
+	if b.Bench.Threshold == nil {
+		return 0
+	}
+	return *b.Bench.Threshold
+}
+
+// BenchAlpha is the significance level a benchmark change must reach to count as a regression
+func (b *buildTemplate) BenchAlpha() float64 {
+	if b.Bench.Alpha == nil {
+		return 0.05
+	}
+	return *b.Bench.Alpha
+}
+
+func (b *buildTemplate) BenchFlags() []string {
+	return b.varStrArray("benchFlags")
+}
+
+type testConfig struct {
+	Retries           *int              `toml:"retries"`
+	Quarantine        map[string]string `toml:"quarantine"`
+	SlowTestThreshold string            `toml:"slowTestThreshold"`
+	FailSlowTests     *bool             `toml:"failSlowTests"`
+	// Coverpkg is "module" or a list of package patterns to pass as -coverpkg
+	Coverpkg interface{} `toml:"coverpkg"`
+}
+
+func (t *testConfig) MergeFrom(from *testConfig) {
+	if from == nil {
+		return
+	}
+	if from.Retries != nil {
+		retries := *from.Retries
+		t.Retries = &retries
+	}
+	if from.Coverpkg != nil {
+		t.Coverpkg = from.Coverpkg
+	}
+	if from.SlowTestThreshold != "" {
+		t.SlowTestThreshold = from.SlowTestThreshold
+	}
+	if from.FailSlowTests != nil {
+		fail := *from.FailSlowTests
+		t.FailSlowTests = &fail
+	}
+	if len(from.Quarantine) > 0 && t.Quarantine == nil {
+		t.Quarantine = make(map[string]string, len(from.Quarantine))
+	}
+	for k, v := range from.Quarantine {
+		t.Quarantine[k] = v
+	}
+}
+
+// TestRetries is how many times failed tests are rerun before the failure counts
+func (b *buildTemplate) TestRetries() int {
+	if b.Test.Retries == nil {
+		return 0
+	}
+	return *b.Test.Retries
+}
+
+// coverpkgModule is the coverpkg setting for every package in the module or GOPATH project
+const coverpkgModule = "module"
+
+// CoverPackages are the package patterns to measure coverage of, or empty to only measure the
+// package being tested
+func (b *buildTemplate) CoverPackages() []string {
+	switch c := b.Test.Coverpkg.(type) {
+	case string:
+		if c == "" {
+			return nil
+		}
+		return []string{c}
+	case []interface{}:
+		ret := make([]string, 0, len(c))
+		for _, p := range c {
+			if s, ok := p.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+// SlowTestThreshold is how long a test can run before it is reported as slow.  Zero disables the check.
+func (b *buildTemplate) SlowTestThreshold() (time.Duration, error) {
+	if b.Test.SlowTestThreshold == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(b.Test.SlowTestThreshold)
+}
+
+// FailSlowTests is true if tests over the slowTestThreshold fail the build, rather than warn
+func (b *buildTemplate) FailSlowTests() bool {
+	return b.Test.FailSlowTests != nil && *b.Test.FailSlowTests
+}
+
+type check struct {
+	Phases  []string            `toml:"phases"`
+	Depends map[string][]string `toml:"depends"`
+}
+
+func (c *check) MergeFrom(from *check) {
+	if from == nil {
+		return
+	}
+	if from.Phases != nil {
+		c.Phases = append([]string{}, from.Phases...)
+	}
+	if len(from.Depends) > 0 && c.Depends == nil {
+		c.Depends = make(map[string][]string, len(from.Depends))
+	}
+	for k, v := range from.Depends {
+		c.Depends[k] = v
+	}
 }
 
 type fixes struct {
@@ -106,6 +366,18 @@ func (b *buildTemplate) MergeFrom(from *buildTemplate) {
 	b.Install.MergeFrom(&from.Install)
 	b.Metalinter.MergeFrom(&from.Metalinter)
 	b.Fix.MergeFrom(&from.Fix)
+	b.Check.MergeFrom(&from.Check)
+	b.Test.MergeFrom(&from.Test)
+	b.Bench.MergeFrom(&from.Bench)
+	b.Fuzz.MergeFrom(&from.Fuzz)
+	b.Integration.MergeFrom(&from.Integration)
+	if len(from.hooks) > 0 && b.hooks == nil {
+		b.hooks = make(map[string][]hook, len(from.hooks))
+	}
+	for k, v := range from.hooks {
+		// Hooks add to, rather than replace, the hooks of parent directories
+		b.hooks[k] = append(b.hooks[k], v...)
+	}
 	if len(from.Vars) > 0 && b.Vars == nil {
 		b.Vars = make(map[string]interface{}, len(from.Vars))
 	}
@@ -152,6 +424,18 @@ func (b *buildTemplate) varFloat(name string) float64 {
 	return b.Vars[name].(float64)
 }
 
+// varNumber reads a numeric var.  TOML decodes 1 as an int64 and 1.0 as a float64, so both are
+// accepted.
+func (b *buildTemplate) varNumber(name string) (float64, error) {
+	switch v := b.Vars[name].(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("[vars] %s must be a number, not %v", name, b.Vars[name])
+}
+
 func varStrArray(vars map[string]interface{}, name string) []string {
 	ignores, exists := vars[name]
 	if !exists {
@@ -182,6 +466,7 @@ func init() {
 type templateCache struct {
 	cache      map[string]*buildTemplate
 	verboseLog logger
+	mu         sync.Mutex
 }
 
 const buildFileName = "gobuild.toml"
@@ -203,7 +488,20 @@ func (t *templateCache) curDirTemplate(dir string) (*buildTemplate, error) {
 	return currentDirTemplate, nil
 }
 
+// reset forgets every loaded template, so changed gobuild.toml files are read again
+func (t *templateCache) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cache = make(map[string]*buildTemplate)
+}
+
 func (t *templateCache) loadInDir(dir string) (*buildTemplate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loadInDirLocked(dir)
+}
+
+func (t *templateCache) loadInDirLocked(dir string) (*buildTemplate, error) {
 	t.verboseLog.Printf("Loading template for %s", dir)
 	if dir == "" {
 		return &defaultLoadedTemplate, nil
@@ -220,10 +518,15 @@ func (t *templateCache) loadInDir(dir string) (*buildTemplate, error) {
 	if err != nil {
 		return nil, wraperr(err, "cannot load templtae for current directory")
 	}
+	if currentDirTemplate != nil {
+		if err := currentDirTemplate.resolveHooks(dir); err != nil {
+			return nil, err
+		}
+	}
 	parentDirTemplate := &defaultLoadedTemplate
 	if t.shouldLoadParent(dir, currentDirTemplate) {
 		if parent := filepath.Dir(dir); parent != dir {
-			if parentDirTemplate, err = t.loadInDir(parent); err != nil {
+			if parentDirTemplate, err = t.loadInDirLocked(parent); err != nil {
 				return nil, wraperr(err, "cannot load parent template %s", parent)
 			}
 		}
@@ -251,9 +554,12 @@ func (t *templateCache) shouldLoadParent(dir string, currTemplate *buildTemplate
 }
 
 type pathExpansion struct {
-	forceAbs bool
-	log      logger
-	template *templateCache
+	forceAbs  bool
+	since     string
+	affected  bool
+	chunkSize int
+	log       logger
+	template  *templateCache
 }
 
 func (p *pathExpansion) singlePath(path string) string {
@@ -261,15 +567,7 @@ func (p *pathExpansion) singlePath(path string) string {
 	if !p.forceAbs && !filepath.IsAbs(path) {
 		return filepath.Clean("./" + path)
 	}
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		return path
-	}
-	symPath, err := filepath.EvalSymlinks(absPath)
-	if err != nil {
-		return absPath
-	}
-	return symPath
+	return realPath(path)
 }
 
 func (p *pathExpansion) matchDir(storeInto map[string]struct{}) filepath.WalkFunc {
@@ -306,7 +604,7 @@ func (p *pathExpansion) matchDir(storeInto map[string]struct{}) filepath.WalkFun
 	}
 }
 
-func (p *pathExpansion) expandPaths(paths []string) ([]string, error) {
+func (p *pathExpansion) expandPaths(ctx context.Context, paths []string) ([]string, error) {
 	files := make(map[string]struct{}, len(paths))
 	cb := p.matchDir(files)
 	for _, path := range paths {
@@ -322,6 +620,18 @@ func (p *pathExpansion) expandPaths(paths []string) ([]string, error) {
 			}
 		}
 	}
+	if p.since != "" {
+		changed, err := p.changedSince(ctx, files)
+		if err != nil {
+			return nil, wraperr(err, "cannot find directories changed since %s", p.since)
+		}
+		if p.affected {
+			if changed, err = p.withDependents(ctx, files, changed); err != nil {
+				return nil, wraperr(err, "cannot find directories depending on changes since %s", p.since)
+			}
+		}
+		files = changed
+	}
 	out := make([]string, 0, len(files))
 	for d := range files {
 		out = append(out, d)
@@ -329,3 +639,20 @@ func (p *pathExpansion) expandPaths(paths []string) ([]string, error) {
 	sort.Strings(out)
 	return out, nil
 }
+
+// changedSince returns the directories in files that have changes relative to p.since
+func (p *pathExpansion) changedSince(ctx context.Context, files map[string]struct{}) (map[string]struct{}, error) {
+	changed, err := changedDirs(ctx, p.since)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]struct{}, len(changed))
+	for d := range files {
+		if _, exists := changed[realPath(d)]; exists {
+			ret[d] = struct{}{}
+		} else {
+			p.log.Printf("Skipping %s: unchanged since %s", d, p.since)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// testEvent is one event from `go test -json`, as described by `go doc test2json`
+type testEvent struct {
+	Time    time.Time `json:",omitempty"`
+	Action  string
+	Package string  `json:",omitempty"`
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+	// ImportPath is set instead of Package on build-output and build-fail events
+	ImportPath string `json:",omitempty"`
+	// Attempt is added by gobuild to events from retries of failed tests
+	Attempt int `json:",omitempty"`
+}
+
+func (e *testEvent) elapsed() time.Duration {
+	return time.Duration(e.Elapsed * float64(time.Second))
+}
+
+// testEventWriter decodes `go test -json` output as it is written.  It keeps every event and
+// writes the plain text test output to out, so the console looks like `go test -v`.
+type testEventWriter struct {
+	out     io.Writer
+	events  []testEvent
+	partial []byte
+}
+
+func (t *testEventWriter) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	for {
+		idx := bytes.IndexByte(t.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := t.handleLine(t.partial[:idx+1]); err != nil {
+			return 0, err
+		}
+		t.partial = t.partial[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush handles any final line that did not end in a newline
+func (t *testEventWriter) Flush() error {
+	if len(t.partial) == 0 {
+		return nil
+	}
+	line := append(t.partial, '\n')
+	t.partial = nil
+	return t.handleLine(line)
+}
+
+func (t *testEventWriter) handleLine(line []byte) error {
+	var ev testEvent
+	if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &ev) != nil {
+		// Not an event: go itself can print directly to stdout
+		_, err := t.out.Write(line)
+		return err
+	}
+	t.events = append(t.events, ev)
+	if ev.Output != "" {
+		if _, err := io.WriteString(t.out, ev.Output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTestEvents(w io.Writer, events []testEvent) error {
+	enc := json.NewEncoder(w)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return wraperr(err, "cannot encode test event")
+		}
+	}
+	return nil
+}
+
+func readTestEvents(r io.Reader) ([]testEvent, error) {
+	ret := make([]testEvent, 0, 100)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for s.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			return nil, wraperr(err, "invalid test event %s", s.Text())
+		}
+		ret = append(ret, ev)
+	}
+	if err := s.Err(); err != nil {
+		return nil, wraperr(err, "cannot read test events")
+	}
+	return ret, nil
+}
+
+var (
+	testRunLine     = regexp.MustCompile(`^=== (?:RUN|PAUSE|CONT|NAME)\s+(\S+)\s*$`)
+	testResultLine  = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \((\d+\.\d+)(?:s| seconds)\)$`)
+	packageDoneLine = regexp.MustCompile(`^(ok|FAIL|\?)\s+(\S+)\s+(\d+\.\d+s|\(cached\)|\[.*\])`)
+)
+
+// isFramingOutput is true for the lines go test prints around each test, which are already
+// represented by the test's status and duration
+func isFramingOutput(line string) bool {
+	return testRunLine.MatchString(line) || testResultLine.MatchString(line)
+}
+
+// packagesFromEvents groups test events into per package results, in the order packages appear
+func packagesFromEvents(events []testEvent) []*packageTests {
+	ret := make([]*packageTests, 0, 10)
+	byName := make(map[string]*packageTests, 10)
+	skipped := make(map[string]bool, 10)
+	lastEvent := make(map[string]time.Time, 10)
+	pkgNamed := func(name string) *packageTests {
+		if p, exists := byName[name]; exists {
+			return p
+		}
+		p := &packageTests{name: name}
+		byName[name] = p
+		ret = append(ret, p)
+		return p
+	}
+	for i := range events {
+		ev := &events[i]
+		if ev.Package == "" {
+			if ev.Action == "build-output" && ev.ImportPath != "" {
+				// Build output import paths look like "pkg [pkg.test]"
+				pkg := pkgNamed(strings.Fields(ev.ImportPath)[0])
+				pkg.output = append(pkg.output, strings.TrimSuffix(ev.Output, "\n"))
+			}
+			continue
+		}
+		pkg := pkgNamed(ev.Package)
+		if ev.Time.After(lastEvent[pkg.name]) {
+			lastEvent[pkg.name] = ev.Time
+		}
+		if ev.Test == "" {
+			switch ev.Action {
+			case "output":
+				line := strings.TrimSuffix(ev.Output, "\n")
+				if line != "PASS" && line != "FAIL" && !strings.HasPrefix(line, "coverage: ") && !packageDoneLine.MatchString(line) {
+					pkg.output = append(pkg.output, line)
+				}
+			case testPass, testFail, testSkip:
+				pkg.failed = ev.Action == testFail
+				if ev.Attempt == 0 {
+					pkg.duration = ev.elapsed()
+				} else {
+					pkg.duration += ev.elapsed()
+				}
+				skipped[ev.Package] = ev.Action == testSkip
+			}
+			continue
+		}
+		t := pkg.testNamed(ev.Test)
+		switch ev.Action {
+		case "run":
+			t.started = ev.Time
+		case "output":
+			line := strings.TrimSuffix(ev.Output, "\n")
+			if !isFramingOutput(line) && (ev.Attempt == 0 || t.status != testFail) {
+				t.output = append(t.output, line)
+			}
+		case testPass, testFail, testSkip:
+			if ev.Attempt > 0 && t.status == testFail && ev.Action == testPass {
+				// Keep the original failure output, so the flaky failure can be reported
+				t.flaky = true
+			} else if ev.Attempt > 0 && t.status == testFail {
+				continue
+			}
+			t.status = ev.Action
+			t.duration = ev.elapsed()
+		case actionQuarantine:
+			t.quarantined = true
+			t.quarantineReason = ev.Output
+		}
+	}
+	filtered := ret[:0]
+	for _, p := range ret {
+		for _, t := range p.tests {
+			if t.status == "" && !t.started.IsZero() {
+				// The test was still running when the package ended, such as on a timeout
+				t.duration = lastEvent[p.name].Sub(t.started)
+			}
+		}
+		if !skipped[p.name] {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// testTimings maps test directories to how many seconds their tests took
+type testTimings map[string]float64
+
+// loadTestTimings merges every timings file matching glob.  Missing files are not an error, since
+// the first run never has history.
+func loadTestTimings(glob string) (testTimings, error) {
+	filenames, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, wraperr(err, "invalid timings pattern %s", glob)
+	}
+	ret := make(testTimings)
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, wraperr(err, "cannot open timings file %s", filename)
+		}
+		var fileTimings testTimings
+		err = json.NewDecoder(f).Decode(&fileTimings)
+		if err := multiErr([]error{err, f.Close()}); err != nil {
+			return nil, wraperr(err, "cannot decode timings file %s", filename)
+		}
+		for dir, seconds := range fileTimings {
+			ret[dir] = seconds
+		}
+	}
+	return ret, nil
+}
+
+func (t testTimings) write(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return wraperr(err, "cannot create timings file %s", filename)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return multiErr([]error{enc.Encode(t), f.Close()})
+}
+
+// hash identifies the timings a split was computed from.  Shards agree on the split only if they
+// print the same hash.
+func (t testTimings) hash() string {
+	// encoding/json sorts map keys, so equal timings always encode the same way
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// balance splits dirs into total groups that should take about the same time to test.  Directories
+// with history are bin packed, longest first, onto the least loaded group.  Directories without
+// history are spread evenly, so nil timings is a round robin split.  The result only depends on
+// dirs and t: shards only agree on the split if they load the same timings.
+func (t testTimings) balance(dirs []string, total int) [][]string {
+	known := make([]string, 0, len(dirs))
+	unknown := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		if _, exists := t[d]; exists {
+			known = append(known, d)
+		} else {
+			unknown = append(unknown, d)
+		}
+	}
+	sort.Slice(known, func(i, j int) bool {
+		if t[known[i]] != t[known[j]] {
+			return t[known[i]] > t[known[j]]
+		}
+		return known[i] < known[j]
+	})
+	sort.Strings(unknown)
+
+	ret := make([][]string, total)
+	loads := make([]float64, total)
+	for _, d := range known {
+		least := 0
+		for i := range loads {
+			if loads[i] < loads[least] {
+				least = i
+			}
+		}
+		ret[least] = append(ret[least], d)
+		loads[least] += t[d]
+	}
+	for i, d := range unknown {
+		ret[i%total] = append(ret[i%total], d)
+	}
+	for _, group := range ret {
+		sort.Strings(group)
+	}
+	return ret
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cep21/gobuild/internal/golang.org/x/net/context"
+)
+
+// watchCmd polls the expanded directories for file changes and reruns a command on the directories
+// that changed
+type watchCmd struct {
+	cmdName string
+	run     func(context.Context, []string) error
+	paths   []string
+	pe      *pathExpansion
+	cache   *templateCache
+	// delay is both the poll interval and how long files must stay unchanged before a run
+	delay time.Duration
+
+	out        io.Writer
+	verboseLog logger
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// dirSnapshot maps directory to the files inside it
+type dirSnapshot map[string]map[string]fileState
+
+func (w *watchCmd) snapshot(ctx context.Context) (dirSnapshot, error) {
+	dirs, err := w.pe.expandPaths(ctx, w.paths)
+	if err != nil {
+		return nil, wraperr(err, "cannot expand paths %s", strings.Join(w.paths, ","))
+	}
+	ret := make(dirSnapshot, len(dirs))
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			w.verboseLog.Printf("Cannot read %s: %s", dir, err.Error())
+			continue
+		}
+		files := make(map[string]fileState, len(infos))
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files[info.Name()] = fileState{size: info.Size(), modTime: info.ModTime()}
+			}
+		}
+		ret[dir] = files
+	}
+	return ret, nil
+}
+
+// changedFiles returns the paths of files added, removed or modified between before and after
+func changedFiles(before, after dirSnapshot) []string {
+	ret := make([]string, 0, 4)
+	for dir, files := range after {
+		for name, state := range files {
+			if old, exists := before[dir][name]; !exists || old.size != state.size || !old.modTime.Equal(state.modTime) {
+				ret = append(ret, filepath.Join(dir, name))
+			}
+		}
+	}
+	for dir, files := range before {
+		for name := range files {
+			if _, exists := after[dir][name]; !exists {
+				ret = append(ret, filepath.Join(dir, name))
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// waitForQuiet keeps taking snapshots until one matches the previous snapshot, so a burst of saves
+// causes a single run.  It returns the last snapshot and every file changed since before.
+func (w *watchCmd) waitForQuiet(ctx context.Context, before dirSnapshot, current dirSnapshot) (dirSnapshot, []string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return current, nil, nil
+		case <-time.After(w.delay):
+		}
+		next, err := w.snapshot(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(changedFiles(current, next)) == 0 {
+			return next, changedFiles(before, next), nil
+		}
+		current = next
+	}
+}
+
+func (w *watchCmd) Run(ctx context.Context) error {
+	snap, err := w.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w.out, "[watch] watching %d directories for %s\n", len(snap), w.cmdName)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.delay):
+		}
+		next, err := w.snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if len(changedFiles(snap, next)) == 0 {
+			continue
+		}
+		next, changed, err := w.waitForQuiet(ctx, snap, next)
+		if err != nil {
+			return err
+		}
+		snap = next
+		if ctx.Err() != nil {
+			return nil
+		}
+		w.runChanged(ctx, snap, changed)
+	}
+}
+
+// runChanged reruns the command on the directories, still being watched, that hold changed files
+func (w *watchCmd) runChanged(ctx context.Context, snap dirSnapshot, changed []string) {
+	dirSet := make(map[string]struct{}, len(changed))
+	for _, f := range changed {
+		if filepath.Base(f) == buildFileName {
+			w.cache.reset()
+		}
+		if _, exists := snap[filepath.Dir(f)]; exists {
+			dirSet[filepath.Dir(f)] = struct{}{}
+		}
+	}
+	if len(dirSet) == 0 {
+		return
+	}
+	dirs := make([]string, 0, len(dirSet))
+	for d := range dirSet {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	w.verboseLog.Printf("Rerunning %s on %s", w.cmdName, strings.Join(dirs, ", "))
+	start := time.Now()
+	err := w.run(ctx, dirs)
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(w.out, "[watch] %s FAIL %s (%s): %s\n", w.cmdName, strings.Join(dirs, " "), took, err.Error())
+		return
+	}
+	fmt.Fprintf(w.out, "[watch] %s PASS %s (%s)\n", w.cmdName, strings.Join(dirs, " "), took)
+}